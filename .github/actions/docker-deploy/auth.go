@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// minRSAKeyBits is the smallest RSA modulus accepted for deploy keys
+const minRSAKeyBits = 2048
+
+// PrivateKey is a parsed private key together with what was detected about it
+type PrivateKey struct {
+	Signer    ssh.Signer
+	Type      string // ed25519, rsa, ecdsa or dsa
+	Bits      int
+	Format    string // OpenSSH, PKCS#8, or legacy PEM
+	Encrypted bool
+}
+
+// String describes the key for log output, e.g. "ed25519 key (OpenSSH format, encrypted)"
+func (k *PrivateKey) String() string {
+	desc := k.Type
+	if k.Type != "ed25519" {
+		desc = fmt.Sprintf("%s-%d", k.Type, k.Bits)
+	}
+	details := k.Format + " format"
+	if k.Encrypted {
+		details += ", encrypted"
+	}
+	return fmt.Sprintf("%s key (%s)", desc, details)
+}
+
+// ParsePrivateKey parses a PEM encoded private key, decrypting it with
+// passphrase when it is encrypted, and rejects key types that are too weak
+func ParsePrivateKey(key, passphrase string) (*PrivateKey, error) {
+	pemBytes := []byte(strings.TrimSpace(strings.ReplaceAll(key, "\r\n", "\n")) + "\n")
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+
+	info := &PrivateKey{Format: keyFormat(block.Type)}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("encrypted PKCS#8 keys are not supported; convert the key to OpenSSH format with `ssh-keygen -p -f <key>`")
+	}
+
+	raw, err := ssh.ParseRawPrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		info.Encrypted = true
+		if passphrase == "" {
+			return nil, fmt.Errorf("private key (%s format) is encrypted; set ssh_key_passphrase", info.Format)
+		}
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, fmt.Errorf("failed to decrypt private key (%s format): incorrect ssh_key_passphrase", info.Format)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key (%s format): %v", info.Format, err)
+	}
+
+	switch k := raw.(type) {
+	case ed25519.PrivateKey, *ed25519.PrivateKey:
+		info.Type, info.Bits = "ed25519", 256
+	case *rsa.PrivateKey:
+		info.Type, info.Bits = "rsa", k.N.BitLen()
+	case *ecdsa.PrivateKey:
+		info.Type, info.Bits = "ecdsa", k.Curve.Params().BitSize
+	case *dsa.PrivateKey:
+		info.Type, info.Bits = "dsa", k.P.BitLen()
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", raw)
+	}
+
+	if err := checkKeyStrength(info); err != nil {
+		return nil, err
+	}
+
+	info.Signer, err = ssh.NewSignerFromKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signer for %s: %v", info, err)
+	}
+	return info, nil
+}
+
+// checkKeyStrength rejects DSA keys and RSA keys below minRSAKeyBits
+func checkKeyStrength(k *PrivateKey) error {
+	switch {
+	case k.Type == "dsa":
+		return fmt.Errorf("%s is not allowed: DSA keys are deprecated and insecure, use ed25519", k)
+	case k.Type == "rsa" && k.Bits < minRSAKeyBits:
+		return fmt.Errorf("%s is too weak: RSA keys must be at least %d bits", k, minRSAKeyBits)
+	}
+	return nil
+}
+
+// keyFormat names the encoding of a PEM block type
+func keyFormat(blockType string) string {
+	switch blockType {
+	case "OPENSSH PRIVATE KEY":
+		return "OpenSSH"
+	case "PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+		return "PKCS#8"
+	case "RSA PRIVATE KEY", "EC PRIVATE KEY", "DSA PRIVATE KEY":
+		return "legacy PEM"
+	default:
+		return blockType
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func marshalOpenSSHKey(t testing.TB, key interface{}, passphrase string) string {
+	var block *pem.Block
+	var err error
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return string(pem.EncodeToMemory(block))
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ecdsa key: %v", err)
+	}
+	weakRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("failed to marshal pkcs8 key: %v", err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("failed to marshal ec key: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		key        string
+		passphrase string
+		wantType   string
+		wantFormat string
+		wantErr    string
+	}{
+		{
+			name:       "openssh_ed25519",
+			key:        marshalOpenSSHKey(t, edKey, ""),
+			wantType:   "ed25519",
+			wantFormat: "OpenSSH",
+		},
+		{
+			name:       "openssh_ed25519_crlf",
+			key:        strings.ReplaceAll(marshalOpenSSHKey(t, edKey, ""), "\n", "\r\n"),
+			wantType:   "ed25519",
+			wantFormat: "OpenSSH",
+		},
+		{
+			name:       "encrypted_ed25519",
+			key:        marshalOpenSSHKey(t, edKey, "s3cret"),
+			passphrase: "s3cret",
+			wantType:   "ed25519",
+			wantFormat: "OpenSSH",
+		},
+		{
+			name:    "encrypted_without_passphrase",
+			key:     marshalOpenSSHKey(t, edKey, "s3cret"),
+			wantErr: "ssh_key_passphrase",
+		},
+		{
+			name:       "encrypted_wrong_passphrase",
+			key:        marshalOpenSSHKey(t, edKey, "s3cret"),
+			passphrase: "wrong",
+			wantErr:    "incorrect ssh_key_passphrase",
+		},
+		{
+			name:       "unencrypted_with_passphrase",
+			key:        marshalOpenSSHKey(t, edKey, ""),
+			passphrase: "unused",
+			wantType:   "ed25519",
+			wantFormat: "OpenSSH",
+		},
+		{
+			name:       "pkcs8_ecdsa",
+			key:        string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+			wantType:   "ecdsa",
+			wantFormat: "PKCS#8",
+		},
+		{
+			name:       "legacy_pem_ecdsa",
+			key:        string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})),
+			wantType:   "ecdsa",
+			wantFormat: "legacy PEM",
+		},
+		{
+			name:    "weak_rsa",
+			key:     string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(weakRSA)})),
+			wantErr: "too weak",
+		},
+		{
+			name:    "encrypted_pkcs8",
+			key:     string(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte("x")})),
+			wantErr: "not supported",
+		},
+		{
+			name:    "not_pem",
+			key:     "invalid-key",
+			wantErr: "no PEM",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParsePrivateKey(tt.key, tt.passphrase)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParsePrivateKey() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePrivateKey() returned unexpected error: %v", err)
+			}
+			if key.Type != tt.wantType || key.Format != tt.wantFormat {
+				t.Errorf("ParsePrivateKey() = %s/%s, want %s/%s", key.Type, key.Format, tt.wantType, tt.wantFormat)
+			}
+			if key.Encrypted != (tt.passphrase != "" && tt.name != "unencrypted_with_passphrase") {
+				t.Errorf("ParsePrivateKey() Encrypted = %v", key.Encrypted)
+			}
+			if key.Signer == nil {
+				t.Error("ParsePrivateKey() returned nil signer")
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// resolveExtraFiles expands the extra_files entries (files, directories or
+// glob patterns) relative to baseDir. It returns the matched paths relative
+// to baseDir in slash form; entries may not point outside of baseDir.
+func resolveExtraFiles(baseDir string, entries []string) ([]string, error) {
+	seen := map[string]bool{}
+	var matches []string
+
+	for _, entry := range entries {
+		clean := path.Clean(filepath.ToSlash(entry))
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, fmt.Errorf("extra file %q must be relative to the compose file directory", entry)
+		}
+
+		pattern := filepath.Join(baseDir, filepath.FromSlash(clean))
+		found, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", entry, err)
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("extra file %q matched nothing in %s", entry, baseDir)
+		}
+
+		sort.Strings(found)
+		for _, f := range found {
+			rel, err := filepath.Rel(baseDir, f)
+			if err != nil {
+				return nil, err
+			}
+			rel = filepath.ToSlash(rel)
+			if !seen[rel] {
+				seen[rel] = true
+				matches = append(matches, rel)
+			}
+		}
+	}
+	return matches, nil
+}
+
+// transferExtraFiles uploads the resolved extra files and directories into
+// remoteDir, next to the remote compose file
+func transferExtraFiles(ctx context.Context, client *SSHClient, baseDir, remoteDir string, entries []string) ([]TransferredFile, error) {
+	matches, err := resolveExtraFiles(baseDir, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []TransferredFile
+	for _, rel := range matches {
+		localPath := filepath.Join(baseDir, filepath.FromSlash(rel))
+		remotePath := path.Join(remoteDir, rel)
+		fi, err := os.Stat(localPath)
+		if err != nil {
+			return files, fmt.Errorf("failed to stat %s: %v", localPath, err)
+		}
+
+		if fi.IsDir() {
+			dirFiles, err := client.TransferDir(ctx, localPath, remotePath)
+			files = append(files, dirFiles...)
+			if err != nil {
+				return files, err
+			}
+			continue
+		}
+
+		if err := client.TransferFileWithRemotePath(ctx, localPath, remotePath); err != nil {
+			return files, err
+		}
+		files = append(files, TransferredFile{
+			LocalPath:  localPath,
+			RemotePath: remotePath,
+			Size:       fi.Size(),
+			Mode:       fi.Mode().Perm(),
+		})
+	}
+	return files, nil
+}
+
+// formatSize renders a byte count for the transfer summary
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
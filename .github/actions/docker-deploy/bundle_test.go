@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTestFiles(t testing.TB, dir string, files map[string]os.FileMode) {
+	t.Helper()
+	for name, mode := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(p, []byte("content of "+name), mode); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+}
+
+func TestResolveExtraFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]os.FileMode{
+		"nginx/default.conf": 0644,
+		"init/01-schema.sql": 0644,
+		"init/02-data.sql":   0644,
+		"init/README.md":     0644,
+		"certs/server.crt":   0600,
+	})
+
+	tests := []struct {
+		name    string
+		entries []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "directory", entries: []string{"nginx/"}, want: []string{"nginx"}},
+		{name: "glob", entries: []string{"init/*.sql"}, want: []string{"init/01-schema.sql", "init/02-data.sql"}},
+		{name: "file_and_duplicate", entries: []string{"certs/server.crt", "./certs/server.crt"}, want: []string{"certs/server.crt"}},
+		{name: "no_match", entries: []string{"missing.conf"}, wantErr: true},
+		{name: "parent_directory", entries: []string{"../secrets"}, wantErr: true},
+		{name: "absolute", entries: []string{"/etc/passwd"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveExtraFiles(dir, tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveExtraFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveExtraFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransferExtraFiles(t *testing.T) {
+	server, client := newTestClient(t)
+
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]os.FileMode{
+		"nginx/default.conf":         0644,
+		"nginx/conf.d/upstream.conf": 0640,
+		"init/01-schema.sql":         0644,
+		"scripts/entrypoint.sh":      0755,
+	})
+
+	files, err := transferExtraFiles(context.Background(), client, dir, ".", []string{"nginx", "init/*.sql", "scripts/entrypoint.sh"})
+	if err != nil {
+		t.Fatalf("transferExtraFiles() returned unexpected error: %v", err)
+	}
+
+	want := map[string]os.FileMode{
+		"nginx/conf.d/upstream.conf": 0640,
+		"nginx/default.conf":         0644,
+		"init/01-schema.sql":         0644,
+		"scripts/entrypoint.sh":      0755,
+	}
+	if len(files) != len(want) {
+		t.Fatalf("transferExtraFiles() transferred %d files, want %d: %+v", len(files), len(want), files)
+	}
+	for _, f := range files {
+		mode, ok := want[f.RemotePath]
+		if !ok {
+			t.Errorf("unexpected remote path %s", f.RemotePath)
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(server.Dir, filepath.FromSlash(f.RemotePath)))
+		if err != nil {
+			t.Errorf("remote file %s missing: %v", f.RemotePath, err)
+			continue
+		}
+		if fi.Mode().Perm() != mode || f.Mode != mode {
+			t.Errorf("%s mode = %04o (reported %04o), want %04o", f.RemotePath, fi.Mode().Perm(), f.Mode, mode)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[int64]string{
+		0:       "0 B",
+		1023:    "1023 B",
+		1536:    "1.5 KiB",
+		5 << 20: "5.0 MiB",
+	}
+	for n, want := range tests {
+		if got := formatSize(n); got != want {
+			t.Errorf("formatSize(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
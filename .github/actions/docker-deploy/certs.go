@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// certAlgorithms are the host certificate algorithms requested when host
+// certificates can be verified
+var certAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSASHA512v01,
+	ssh.CertAlgoRSASHA256v01,
+}
+
+// plainAlgorithms are the plain host key algorithms requested when neither
+// certificates can be verified nor known_hosts lists keys for the host
+var plainAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512,
+	ssh.KeyAlgoRSASHA256,
+	ssh.KeyAlgoRSA,
+}
+
+// ParseCertificate parses an OpenSSH certificate in authorized_keys format,
+// e.g. the content of id_ed25519-cert.pub
+func ParseCertificate(value string) (*ssh.Certificate, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(value)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse certificate: got a plain %s public key", pub.Type())
+	}
+	return cert, nil
+}
+
+// NewCertificateSigner checks that a user certificate belongs to key and is
+// valid for user right now, and returns a signer presenting it
+func NewCertificateSigner(cert *ssh.Certificate, key ssh.Signer, user string) (ssh.Signer, error) {
+	if !bytes.Equal(cert.Key.Marshal(), key.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("ssh_certificate was not issued for ssh_key (certificate key %s, private key %s)",
+			ssh.FingerprintSHA256(cert.Key), ssh.FingerprintSHA256(key.PublicKey()))
+	}
+	if err := checkCertificate(cert, ssh.UserCert, user, time.Now()); err != nil {
+		return nil, fmt.Errorf("user certificate rejected: %v", err)
+	}
+
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate signer: %v", err)
+	}
+	return signer, nil
+}
+
+// ParseCertAuthorities parses one CA public key per line (authorized_keys
+// format, an optional "@cert-authority <hosts>" prefix is ignored)
+func ParseCertAuthorities(value string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "@cert-authority") {
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("invalid host_ca line %q", line)
+			}
+			line = strings.Join(fields[2:], " ")
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse host_ca key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// checkCertificate validates the type, principals and validity period of a
+// certificate with descriptive errors. Signatures are checked by ssh.CertChecker.
+func checkCertificate(cert *ssh.Certificate, certType uint32, principal string, now time.Time) error {
+	if cert.CertType != certType {
+		want := "user"
+		if certType == ssh.HostCert {
+			want = "host"
+		}
+		return fmt.Errorf("certificate %q is not a %s certificate", cert.KeyId, want)
+	}
+
+	unix := uint64(now.Unix())
+	if cert.ValidAfter != 0 && unix < cert.ValidAfter {
+		return fmt.Errorf("certificate %q is not valid until %s", cert.KeyId, certTime(cert.ValidAfter))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return fmt.Errorf("certificate %q expired at %s", cert.KeyId, certTime(cert.ValidBefore))
+	}
+
+	if len(cert.ValidPrincipals) > 0 {
+		for _, p := range cert.ValidPrincipals {
+			if p == principal {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate %q is not valid for principal %q (valid principals: %s)",
+			cert.KeyId, principal, strings.Join(cert.ValidPrincipals, ", "))
+	}
+	return nil
+}
+
+func certTime(t uint64) string {
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t testing.TB) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	return signer
+}
+
+// newTestCertificate signs key with ca
+func newTestCertificate(t testing.TB, ca ssh.Signer, key ssh.PublicKey, certType uint32, principals []string, validAfter, validBefore time.Time) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		KeyId:           "test-cert",
+		CertType:        certType,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("failed to sign certificate: %v", err)
+	}
+	return cert
+}
+
+func TestCheckCertificate(t *testing.T) {
+	ca := newTestSigner(t)
+	key := newTestSigner(t).PublicKey()
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		cert      *ssh.Certificate
+		certType  uint32
+		principal string
+		wantErr   string
+	}{
+		{
+			name:      "valid",
+			cert:      newTestCertificate(t, ca, key, ssh.UserCert, []string{"deploy"}, now.Add(-time.Hour), now.Add(time.Hour)),
+			certType:  ssh.UserCert,
+			principal: "deploy",
+		},
+		{
+			name:      "expired",
+			cert:      newTestCertificate(t, ca, key, ssh.UserCert, []string{"deploy"}, now.Add(-2*time.Hour), now.Add(-time.Hour)),
+			certType:  ssh.UserCert,
+			principal: "deploy",
+			wantErr:   "expired at",
+		},
+		{
+			name:      "not_yet_valid",
+			cert:      newTestCertificate(t, ca, key, ssh.UserCert, []string{"deploy"}, now.Add(time.Hour), now.Add(2*time.Hour)),
+			certType:  ssh.UserCert,
+			principal: "deploy",
+			wantErr:   "not valid until",
+		},
+		{
+			name:      "wrong_principal",
+			cert:      newTestCertificate(t, ca, key, ssh.UserCert, []string{"admin", "ops"}, now.Add(-time.Hour), now.Add(time.Hour)),
+			certType:  ssh.UserCert,
+			principal: "deploy",
+			wantErr:   "valid principals: admin, ops",
+		},
+		{
+			name:      "wrong_type",
+			cert:      newTestCertificate(t, ca, key, ssh.UserCert, nil, now.Add(-time.Hour), now.Add(time.Hour)),
+			certType:  ssh.HostCert,
+			principal: "deploy.example.com",
+			wantErr:   "not a host certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCertificate(tt.cert, tt.certType, tt.principal, now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkCertificate() returned unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkCertificate() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewCertificateSigner(t *testing.T) {
+	ca := newTestSigner(t)
+	key := newTestSigner(t)
+	other := newTestSigner(t)
+	now := time.Now()
+
+	cert := newTestCertificate(t, ca, key.PublicKey(), ssh.UserCert, []string{"deploy"}, now.Add(-time.Hour), now.Add(time.Hour))
+	line := string(ssh.MarshalAuthorizedKey(cert))
+
+	parsed, err := ParseCertificate(line)
+	if err != nil {
+		t.Fatalf("ParseCertificate() returned unexpected error: %v", err)
+	}
+
+	signer, err := NewCertificateSigner(parsed, key, "deploy")
+	if err != nil {
+		t.Fatalf("NewCertificateSigner() returned unexpected error: %v", err)
+	}
+	if _, ok := signer.PublicKey().(*ssh.Certificate); !ok {
+		t.Error("NewCertificateSigner() should present the certificate")
+	}
+
+	if _, err := NewCertificateSigner(parsed, other, "deploy"); err == nil || !strings.Contains(err.Error(), "not issued for ssh_key") {
+		t.Errorf("expected key mismatch error, got: %v", err)
+	}
+	if _, err := NewCertificateSigner(parsed, key, "root"); err == nil || !strings.Contains(err.Error(), "principal") {
+		t.Errorf("expected principal error, got: %v", err)
+	}
+	if _, err := ParseCertificate(string(ssh.MarshalAuthorizedKey(key.PublicKey()))); err == nil {
+		t.Error("ParseCertificate() should reject a plain public key")
+	}
+}
+
+func TestHostKeyVerifierHostCA(t *testing.T) {
+	ca := newTestSigner(t)
+	otherCA := newTestSigner(t)
+	hostKey := newTestSigner(t).PublicKey()
+	now := time.Now()
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	hostCA := "@cert-authority *.example.com " + string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+	verifier, err := NewHostKeyVerifier("", "", hostCA)
+	if err != nil {
+		t.Fatalf("NewHostKeyVerifier() returned unexpected error: %v", err)
+	}
+	cb := verifier.Callback()
+
+	valid := newTestCertificate(t, ca, hostKey, ssh.HostCert, []string{"deploy.example.com"}, now.Add(-time.Hour), now.Add(time.Hour))
+	if err := cb("deploy.example.com:22", remote, valid); err != nil {
+		t.Errorf("expected valid host certificate to be accepted, got: %v", err)
+	}
+
+	expired := newTestCertificate(t, ca, hostKey, ssh.HostCert, []string{"deploy.example.com"}, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	if err := cb("deploy.example.com:22", remote, expired); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expected expired host certificate to be rejected, got: %v", err)
+	}
+
+	if err := cb("other.example.com:22", remote, valid); err == nil || !strings.Contains(err.Error(), "principal") {
+		t.Errorf("expected wrong principal to be rejected, got: %v", err)
+	}
+
+	untrusted := newTestCertificate(t, otherCA, hostKey, ssh.HostCert, []string{"deploy.example.com"}, now.Add(-time.Hour), now.Add(time.Hour))
+	if err := cb("deploy.example.com:22", remote, untrusted); err == nil || !strings.Contains(err.Error(), "untrusted") {
+		t.Errorf("expected untrusted CA to be rejected, got: %v", err)
+	}
+
+	if err := cb("deploy.example.com:22", remote, hostKey); err == nil {
+		t.Error("expected plain host key to be rejected when only host_ca is configured")
+	}
+
+	if algos := verifier.HostKeyAlgorithms("deploy.example.com:22"); len(algos) == 0 || algos[0] != ssh.CertAlgoED25519v01 {
+		t.Errorf("HostKeyAlgorithms() = %v, want certificate algorithms first", algos)
+	}
+}
+
+func TestCreateSSHClientWithCertificates(t *testing.T) {
+	server := newTestSSHServer(t)
+	ca := newTestSigner(t)
+	now := time.Now()
+
+	hostCert := newTestCertificate(t, ca, server.HostKey, ssh.HostCert, []string{"127.0.0.1"}, now.Add(-time.Hour), now.Add(time.Hour))
+	server.AddHostCertificate(t, hostCert)
+
+	cfg := server.testSSHConfig(t)
+	cfg.KnownHosts = ""
+	cfg.HostCA = string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+
+	key, err := ParsePrivateKey(cfg.Key, "")
+	if err != nil {
+		t.Fatalf("ParsePrivateKey() returned unexpected error: %v", err)
+	}
+	userCert := newTestCertificate(t, ca, key.Signer.PublicKey(), ssh.UserCert, []string{"deploy"}, now.Add(-time.Hour), now.Add(time.Hour))
+	cfg.Certificate = string(ssh.MarshalAuthorizedKey(userCert))
+
+	client, err := CreateSSHClient(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("CreateSSHClient() returned unexpected error: %v", err)
+	}
+	client.Close()
+
+	expired := newTestCertificate(t, ca, key.Signer.PublicKey(), ssh.UserCert, []string{"deploy"}, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	cfg.Certificate = string(ssh.MarshalAuthorizedKey(expired))
+	if _, err := CreateSSHClient(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expected expired user certificate error, got: %v", err)
+	}
+
+	// A server with a host certificate can be pinned by the fingerprint of
+	// its plain key when no host CA is configured
+	cfg = server.testSSHConfig(t)
+	cfg.KnownHosts = ""
+	cfg.HostFingerprint = ssh.FingerprintSHA256(server.HostKey)
+	client, err = CreateSSHClient(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("CreateSSHClient() with a pinned fingerprint returned unexpected error: %v", err)
+	}
+	client.Close()
+}
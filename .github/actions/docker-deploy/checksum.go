@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// fileDigest pairs a remote path with the expected SHA-256 of its content
+type fileDigest struct {
+	RemotePath string
+	SHA256     string
+}
+
+// localSHA256 returns the hex encoded SHA-256 digest of a local file
+func localSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s for checksum: %v", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read %s for checksum: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sha256Hex returns the hex encoded SHA-256 digest of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// selectSumCommand sets $sum to the SHA-256 command of the remote host.
+// sha256sum is preferred, shasum is used on hosts without coreutils.
+const selectSumCommand = "if command -v sha256sum >/dev/null 2>&1; then sum='sha256sum'; else sum='shasum -a 256'; fi; "
+
+// remoteChecksumCommand prints one line per file, in order: the SHA-256
+// digest, or "missing" when the path is not a regular file
+func remoteChecksumCommand(paths []string) string {
+	return selectSumCommand +
+		"for f in " + strings.Join(quoteAll(paths), " ") + "; do " +
+		`if [ -f "$f" ]; then $sum < "$f" || echo unreadable; else echo missing; fi; ` +
+		"done"
+}
+
+// validateFiles computes the SHA-256 of every remote file and compares it
+// with the expected digest, reporting all mismatches at once
+func validateFiles(ctx context.Context, client *SSHClient, files ...fileDigest) error {
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.RemotePath
+	}
+
+	result, err := client.RunCommand(ctx, remoteChecksumCommand(paths))
+	if err != nil {
+		return fmt.Errorf("failed to validate files: %v", err)
+	}
+	output := result.Stdout
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != len(files) {
+		return fmt.Errorf("failed to validate files: expected %d checksums, got %d lines:\n%s", len(files), len(lines), output)
+	}
+
+	var mismatches []string
+	for i, f := range files {
+		fields := strings.Fields(lines[i])
+		got := ""
+		if len(fields) > 0 {
+			got = fields[0]
+		}
+
+		switch {
+		case got == "missing":
+			mismatches = append(mismatches, fmt.Sprintf("%s: not found on remote host", f.RemotePath))
+		case got == "unreadable":
+			mismatches = append(mismatches, fmt.Sprintf("%s: could not be read on remote host", f.RemotePath))
+		case !strings.EqualFold(got, f.SHA256):
+			mismatches = append(mismatches, fmt.Sprintf("%s: expected sha256 %s, got %s", f.RemotePath, f.SHA256, got))
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("checksum mismatch for %d of %d files:\n  %s", len(mismatches), len(files), strings.Join(mismatches, "\n  "))
+	}
+	return nil
+}
+
+// checksumsJSON renders the digests as a JSON object keyed by remote path
+func checksumsJSON(files []fileDigest) (string, error) {
+	digests := make(map[string]string, len(files))
+	for _, f := range files {
+		digests[f.RemotePath] = f.SHA256
+	}
+	data, err := json.Marshal(digests)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode checksums: %v", err)
+	}
+	return string(data), nil
+}
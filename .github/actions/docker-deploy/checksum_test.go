@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetOutput(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", outputFile)
+
+	if err := setOutput("env_sha256", "abc"); err != nil {
+		t.Fatalf("setOutput() returned unexpected error: %v", err)
+	}
+	if err := setOutput("report", "line1\nline2"); err != nil {
+		t.Fatalf("setOutput() returned unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("failed to read output file: %v", err)
+	}
+	got := string(data)
+	if !strings.HasPrefix(got, "env_sha256=abc\nreport<<ghadelimiter_") || !strings.Contains(got, "\nline1\nline2\nghadelimiter_") {
+		t.Errorf("unexpected output file content:\n%s", got)
+	}
+}
+
+func TestChecksumsJSON(t *testing.T) {
+	out, err := checksumsJSON([]fileDigest{
+		{RemotePath: ".env", SHA256: "aaa"},
+		{RemotePath: "nginx/default.conf", SHA256: "bbb"},
+	})
+	if err != nil {
+		t.Fatalf("checksumsJSON() returned unexpected error: %v", err)
+	}
+
+	var got map[string]string
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("checksumsJSON() returned invalid JSON %q: %v", out, err)
+	}
+	if got[".env"] != "aaa" || got["nginx/default.conf"] != "bbb" {
+		t.Errorf("checksumsJSON() = %v", got)
+	}
+}
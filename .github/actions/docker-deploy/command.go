@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CommandResult holds the outcome of a remote command
+type CommandResult struct {
+	Stdout string
+	Stderr string
+	// ExitCode is -1 when the command did not report an exit status, e.g.
+	// because the session could not be started or the connection dropped
+	ExitCode int
+	// Signal names the signal that terminated the command, without the SIG
+	// prefix (e.g. "TERM")
+	Signal   string
+	Duration time.Duration
+}
+
+// Output returns stdout followed by stderr
+func (r *CommandResult) Output() string {
+	return r.Stdout + r.Stderr
+}
+
+// Status describes how the command ended
+func (r *CommandResult) Status() string {
+	switch {
+	case r.Signal != "":
+		return fmt.Sprintf("killed by signal %s", r.Signal)
+	case r.ExitCode < 0:
+		return "no exit status"
+	default:
+		return fmt.Sprintf("exit code %d", r.ExitCode)
+	}
+}
+
+// StderrTail returns the last n non-empty lines of stderr
+func (r *CommandResult) StderrTail(n int) []string {
+	var lines []string
+	for _, line := range strings.Split(r.Stderr, "\n") {
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// signalGracePeriod is how long a cancelled command may take to exit after
+// SIGTERM before its session is closed
+var signalGracePeriod = 5 * time.Second
+
+// execute runs cmd in a new session, additionally copying its output to
+// stdout and stderr when they are not nil. The result is never nil and
+// carries the captured output also when the command fails.
+//
+// When ctx is cancelled or CommandTimeout expires, the remote process is sent
+// SIGTERM and the session is closed once it exits or the grace period ends.
+func (s *SSHClient) execute(ctx context.Context, cmd string, stdout, stderr io.Writer) (*CommandResult, error) {
+	result := &CommandResult{ExitCode: -1}
+	if s.client == nil {
+		return result, fmt.Errorf("SSH client is nil")
+	}
+	if err := ctx.Err(); err != nil {
+		return result, fmt.Errorf("command not started: %w", err)
+	}
+	if s.CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.CommandTimeout)
+		defer cancel()
+	}
+
+	session, err := s.client.NewSession()
+	if err != nil {
+		return result, fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	var outBuf, errBuf bytes.Buffer
+	session.Stdout = &outBuf
+	session.Stderr = &errBuf
+	if stdout != nil {
+		session.Stdout = io.MultiWriter(&outBuf, stdout)
+	}
+	if stderr != nil {
+		session.Stderr = io.MultiWriter(&errBuf, stderr)
+	}
+
+	start := time.Now()
+	if err := session.Start(cmd); err != nil {
+		return result, fmt.Errorf("failed to start command: %v", err)
+	}
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- session.Wait() }()
+
+	var ctxErr error
+	select {
+	case err = <-waitErr:
+	case <-ctx.Done():
+		ctxErr = ctx.Err()
+		session.Signal(ssh.SIGTERM)
+		select {
+		case err = <-waitErr:
+		case <-time.After(signalGracePeriod):
+			session.Close()
+			err = <-waitErr
+		}
+	}
+	result.Duration = time.Since(start)
+	result.Stdout = outBuf.String()
+	result.Stderr = errBuf.String()
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		result.ExitCode = 0
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitStatus()
+		result.Signal = exitErr.Signal()
+	}
+	if ctxErr != nil {
+		reason := "cancelled"
+		if errors.Is(ctxErr, context.DeadlineExceeded) {
+			reason = "timed out"
+		}
+		return result, fmt.Errorf("command %s after %s: %w", reason, result.Duration.Round(time.Millisecond), ctxErr)
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to run command: %v", err)
+	}
+	return result, nil
+}
+
+// commandError describes a failed remote command with its exit status and
+// the last lines it wrote to stderr
+func commandError(name string, result *CommandResult, err error) error {
+	var msg string
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		msg = fmt.Sprintf("failed to run %s: %v", name, err)
+	case result == nil || (result.ExitCode < 0 && result.Signal == ""):
+		return fmt.Errorf("failed to run %s: %v", name, err)
+	default:
+		msg = fmt.Sprintf("failed to run %s: %s after %s", name, result.Status(), result.Duration.Round(time.Millisecond))
+	}
+	if tail := result.StderrTail(stderrTailLines); len(tail) > 0 {
+		msg += "\nLast stderr lines:\n  " + strings.Join(tail, "\n  ")
+	}
+	return errors.New(msg)
+}
+
+// stderrTailLines is how many stderr lines are reported for failed commands
+const stderrTailLines = 20
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecute(t *testing.T) {
+	_, client := newTestClient(t)
+
+	result, err := client.RunCommand(context.Background(), "echo out; echo err >&2; exit 7")
+	if err == nil {
+		t.Fatal("expected error for non-zero exit code")
+	}
+	if result.Stdout != "out\n" || result.Stderr != "err\n" {
+		t.Errorf("RunCommand() stdout = %q, stderr = %q; want separate streams", result.Stdout, result.Stderr)
+	}
+	if result.ExitCode != 7 || result.Signal != "" || result.Duration <= 0 {
+		t.Errorf("RunCommand() exit code = %d, signal = %q, duration = %s", result.ExitCode, result.Signal, result.Duration)
+	}
+
+	result, err = client.RunCommand(context.Background(), "kill -TERM $$")
+	if err == nil || result.Signal != "TERM" {
+		t.Errorf("RunCommand() signal = %q, err = %v; want TERM", result.Signal, err)
+	}
+	if !strings.Contains(commandError("sleep", result, err).Error(), "killed by signal TERM") {
+		t.Errorf("commandError() = %v", commandError("sleep", result, err))
+	}
+
+	result, err = client.RunCommand(context.Background(), "true")
+	if err != nil || result.ExitCode != 0 {
+		t.Errorf("RunCommand() = %+v, %v; want exit code 0", result, err)
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	server, client := newTestClient(t)
+	client.CommandTimeout = 200 * time.Millisecond
+
+	// The remote process gets SIGTERM and can clean up before the session closes
+	result, err := client.RunCommand(context.Background(), "trap 'echo stopped > marker; exit 143' TERM; sleep 5 >/dev/null 2>&1 & wait")
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("RunCommand() error = %v, want timeout", err)
+	}
+	if result.Duration > 3*time.Second {
+		t.Errorf("timed out command took %s", result.Duration)
+	}
+	if data, err := os.ReadFile(filepath.Join(server.Dir, "marker")); err != nil || string(data) != "stopped\n" {
+		t.Errorf("remote process should have handled SIGTERM, marker = %q, %v", data, err)
+	}
+}
+
+func TestExecuteCancel(t *testing.T) {
+	origGrace := signalGracePeriod
+	signalGracePeriod = 100 * time.Millisecond
+	defer func() { signalGracePeriod = origGrace }()
+
+	server, client := newTestClient(t)
+
+	// A process ignoring SIGTERM is abandoned after the grace period
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := client.RunCommand(ctx, "trap '' TERM; sleep 5")
+	if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("RunCommand() error = %v, want cancellation", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("cancelled command took %s", elapsed)
+	}
+
+	// The connection stays usable and cancelled contexts start nothing
+	if _, err := client.RunCommand(context.Background(), "true"); err != nil {
+		t.Errorf("RunCommand() after cancellation returned unexpected error: %v", err)
+	}
+	if _, err := client.RunCommand(ctx, "touch started"); !errors.Is(err, context.Canceled) {
+		t.Errorf("RunCommand() with cancelled context = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(server.Dir, "started")); err == nil {
+		t.Error("command should not run with a cancelled context")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Action modes
+const (
+	ModeDeploy      = "deploy"       // deploy docker_tag
+	ModeRollback    = "rollback"     // redeploy an earlier release
+	ModeHistory     = "history"      // print the deployment history
+	ModeForceUnlock = "force_unlock" // remove the deploy lock
+)
+
+// Inputs holds the action inputs read from the environment
+type Inputs struct {
+	// Mode is ModeDeploy, ModeRollback, ModeHistory or ModeForceUnlock
+	Mode string
+	SSH  SSHConfig
+
+	TransferMethod string
+	SCPPath        string
+
+	// CommandTimeout bounds every remote command and DeployTimeout the whole
+	// run; 0 disables either limit
+	CommandTimeout time.Duration
+	DeployTimeout  time.Duration
+
+	// ComposeFiles are passed to docker compose as repeated -f flags, in order
+	ComposeFiles []string
+	// Profiles are enabled with --profile
+	Profiles []string
+	// Services limits pull and up to the named services; NoDeps keeps up
+	// from starting their dependencies
+	Services []string
+	NoDeps   bool
+	// WaitTimeout bounds the wait for the deployed services to become
+	// healthy after up; 0 skips the wait
+	WaitTimeout time.Duration
+	// PreDeploy hooks run between pull and up, PostDeploy hooks once the
+	// services are healthy
+	PreDeploy  []Hook
+	PostDeploy []Hook
+	// SmokeChecks run after the services are healthy, each attempt bounded
+	// by SmokeTimeout and retried SmokeRetries times
+	SmokeChecks  []SmokeCheck
+	SmokeRetries int
+	SmokeTimeout time.Duration
+	// AutoRollback restores the previous release when a deploy fails;
+	// RollbackSteps is how far the rollback mode goes back
+	AutoRollback  bool
+	RollbackSteps int
+	// KeepReleases is how many release directories are kept
+	KeepReleases int
+	// HistoryLimit is how many entries the history mode prints, 0 for all
+	HistoryLimit int
+	// LockTimeout is how long to wait for the deploy lock held by another
+	// run; 0 fails right away
+	LockTimeout time.Duration
+
+	// RunID, Actor and Ref identify the workflow run in the history
+	RunID      string
+	Actor      string
+	Ref        string
+	DockerTag  string
+	ExtraFiles []string
+	// Env holds the variables from env_file and env written to .env next to
+	// DOCKER_TAG
+	Env []EnvVar
+	// EnvMode is EnvReplace or EnvMerge
+	EnvMode string
+
+	// RemoteDir is the directory on the remote host that receives every
+	// file and that docker compose runs in
+	RemoteDir string
+	// ProjectName is passed to docker compose as -p when set
+	ProjectName string
+}
+
+// projectNamePattern matches the project names accepted by docker compose
+var projectNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// loadInputs reads and validates the action inputs
+func loadInputs() (*Inputs, error) {
+	mode := strings.TrimSpace(os.Getenv("MODE"))
+	switch mode {
+	case "":
+		mode = ModeDeploy
+	case ModeDeploy, ModeRollback, ModeHistory, ModeForceUnlock:
+	default:
+		return nil, fmt.Errorf("invalid mode %q, expected deploy, rollback, history or force_unlock", mode)
+	}
+
+	config := map[string]string{
+		"sshUser": "SSH_USER",
+		"sshKey":  "SSH_KEY",
+		"sshHost": "SSH_HOST",
+		"sshPort": "SSH_PORT",
+	}
+	if mode == ModeDeploy {
+		config["composeFile"] = "COMPOSE_FILE"
+		config["dockerTag"] = "DOCKER_TAG"
+	}
+
+	for k, v := range config {
+		t := os.Getenv(v)
+		if t == "" {
+			return nil, fmt.Errorf("missing required environment variable: %s", v)
+		}
+		config[k] = t
+	}
+
+	sshPort, err := strconv.Atoi(config["sshPort"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH port: %v", err)
+	}
+
+	connectTimeout, err := envDuration("CONNECT_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	connectRetries, err := envInt("CONNECT_RETRIES", 3)
+	if err != nil {
+		return nil, err
+	}
+	keepaliveInterval, err := envDuration("KEEPALIVE_INTERVAL", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	commandTimeout, err := envDuration("COMMAND_TIMEOUT", 0)
+	if err != nil {
+		return nil, err
+	}
+	deployTimeout, err := envDuration("DEPLOY_TIMEOUT", 30*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	waitTimeout, err := envDuration("WAIT_TIMEOUT", 2*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	smokeChecks, err := parseSmokeChecks(os.Getenv("SMOKE_CHECKS"))
+	if err != nil {
+		return nil, err
+	}
+	smokeRetries, err := envInt("SMOKE_RETRIES", 5)
+	if err != nil {
+		return nil, err
+	}
+	smokeTimeout, err := envDuration("SMOKE_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	transferMethod := strings.TrimSpace(os.Getenv("TRANSFER_METHOD"))
+	switch transferMethod {
+	case "":
+		transferMethod = TransferAuto
+	case TransferAuto, TransferSFTP, TransferSCP:
+	default:
+		return nil, fmt.Errorf("invalid transfer method %q, expected auto, sftp or scp", transferMethod)
+	}
+
+	jumpHosts, err := ParseJumpHosts(os.Getenv("JUMP_HOSTS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid jump hosts: %v", err)
+	}
+
+	env, err := loadEnv(os.Getenv("ENV_FILE"), os.Getenv("ENV_VARS"))
+	if err != nil {
+		return nil, err
+	}
+
+	envMode := strings.TrimSpace(os.Getenv("ENV_MODE"))
+	switch envMode {
+	case "":
+		envMode = EnvReplace
+	case EnvReplace, EnvMerge:
+	default:
+		return nil, fmt.Errorf("invalid env mode %q, expected replace or merge", envMode)
+	}
+
+	composeFiles := parseList(config["composeFile"])
+	if mode == ModeDeploy {
+		if _, err := composeRemotePaths(composeFiles); err != nil {
+			return nil, err
+		}
+	}
+
+	rollbackSteps, err := envInt("ROLLBACK_STEPS", 1)
+	if err != nil {
+		return nil, err
+	}
+	if rollbackSteps < 1 {
+		return nil, fmt.Errorf("invalid rollback steps %d, expected at least 1", rollbackSteps)
+	}
+	keepReleases, err := envInt("KEEP_RELEASES", 10)
+	if err != nil {
+		return nil, err
+	}
+	if keepReleases < 1 {
+		return nil, fmt.Errorf("invalid keep releases %d, expected at least 1", keepReleases)
+	}
+	historyLimit, err := envInt("HISTORY_LIMIT", 20)
+	if err != nil {
+		return nil, err
+	}
+	lockTimeout, err := envDuration("LOCK_TIMEOUT", 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	services := parseList(strings.ReplaceAll(os.Getenv("SERVICES"), ",", "\n"))
+	noDeps := os.Getenv("NO_DEPS") == "true"
+	if noDeps && len(services) == 0 {
+		return nil, fmt.Errorf("no_deps requires services")
+	}
+
+	projectName := strings.TrimSpace(os.Getenv("PROJECT_NAME"))
+	if projectName != "" && !projectNamePattern.MatchString(projectName) {
+		return nil, fmt.Errorf("invalid project name %q: use lowercase letters, digits, dashes and underscores, starting with a letter or digit", projectName)
+	}
+
+	return &Inputs{
+		Mode: mode,
+		SSH: SSHConfig{
+			User:              config["sshUser"],
+			Key:               config["sshKey"],
+			KeyPassphrase:     os.Getenv("SSH_KEY_PASSPHRASE"),
+			Certificate:       os.Getenv("SSH_CERTIFICATE"),
+			Host:              config["sshHost"],
+			Port:              sshPort,
+			KnownHosts:        os.Getenv("KNOWN_HOSTS"),
+			HostFingerprint:   os.Getenv("HOST_FINGERPRINT"),
+			HostCA:            os.Getenv("HOST_CA"),
+			JumpHosts:         jumpHosts,
+			ConnectTimeout:    connectTimeout,
+			Retries:           connectRetries,
+			KeepaliveInterval: keepaliveInterval,
+		},
+		TransferMethod: transferMethod,
+		SCPPath:        os.Getenv("SCP_PATH"),
+		CommandTimeout: commandTimeout,
+		DeployTimeout:  deployTimeout,
+		ComposeFiles:   composeFiles,
+		Profiles:       parseList(strings.ReplaceAll(os.Getenv("PROFILES"), ",", "\n")),
+		Services:       services,
+		NoDeps:         noDeps,
+		WaitTimeout:    waitTimeout,
+		PreDeploy:      parseHooks(os.Getenv("PRE_DEPLOY")),
+		PostDeploy:     parseHooks(os.Getenv("POST_DEPLOY")),
+		SmokeChecks:    smokeChecks,
+		SmokeRetries:   smokeRetries,
+		SmokeTimeout:   smokeTimeout,
+		AutoRollback:   os.Getenv("AUTO_ROLLBACK") != "false",
+		RollbackSteps:  rollbackSteps,
+		KeepReleases:   keepReleases,
+		HistoryLimit:   historyLimit,
+		LockTimeout:    lockTimeout,
+		RunID:          os.Getenv("GITHUB_RUN_ID"),
+		Actor:          os.Getenv("GITHUB_ACTOR"),
+		Ref:            os.Getenv("GITHUB_REF"),
+		DockerTag:      config["dockerTag"],
+		ExtraFiles:     parseList(os.Getenv("EXTRA_FILES")),
+		Env:            env,
+		EnvMode:        envMode,
+		RemoteDir:      normalizeRemoteDir(os.Getenv("REMOTE_DIR")),
+		ProjectName:    projectName,
+	}, nil
+}
+
+// normalizeRemoteDir cleans the remote_dir input. Paths starting with ~/ are
+// made relative, since both SFTP and remote commands start in the home
+// directory; an empty value means the home directory itself.
+func normalizeRemoteDir(dir string) string {
+	dir = strings.TrimSpace(dir)
+	if dir == "~" {
+		return "."
+	}
+	dir = strings.TrimPrefix(dir, "~/")
+	if dir == "" {
+		return "."
+	}
+	return path.Clean(dir)
+}
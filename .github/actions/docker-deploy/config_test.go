@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// setRequiredInputs sets the required inputs to valid values
+func setRequiredInputs(t *testing.T) {
+	t.Helper()
+	for k, v := range map[string]string{
+		"SSH_USER":     "deploy",
+		"SSH_KEY":      "key",
+		"SSH_HOST":     "example.com",
+		"SSH_PORT":     "22",
+		"COMPOSE_FILE": "docker-compose.yml",
+		"DOCKER_TAG":   "abc1234",
+	} {
+		t.Setenv(k, v)
+	}
+}
+
+func TestNormalizeRemoteDir(t *testing.T) {
+	tests := map[string]string{
+		"":                  ".",
+		"~":                 ".",
+		"~/apps/web":        "apps/web",
+		"apps/web/":         "apps/web",
+		"/srv/app/../stack": "/srv/stack",
+		" /srv/app ":        "/srv/app",
+	}
+	for in, want := range tests {
+		if got := normalizeRemoteDir(in); got != want {
+			t.Errorf("normalizeRemoteDir(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestLoadInputs(t *testing.T) {
+	setRequiredInputs(t)
+	t.Setenv("REMOTE_DIR", "~/stacks/web")
+	t.Setenv("PROJECT_NAME", "web_prod-1")
+	t.Setenv("COMPOSE_FILE", "deploy/docker-compose.yml\ndeploy/docker-compose.prod.yml")
+	t.Setenv("PROFILES", "workers, debug")
+	t.Setenv("SERVICES", "api\nworker")
+	t.Setenv("NO_DEPS", "true")
+	t.Setenv("POST_DEPLOY", "- ./warm-cache.sh")
+
+	inputs, err := loadInputs()
+	if err != nil {
+		t.Fatalf("loadInputs() returned unexpected error: %v", err)
+	}
+	if inputs.RemoteDir != "stacks/web" || inputs.ProjectName != "web_prod-1" {
+		t.Errorf("loadInputs() remote dir = %q, project name = %q", inputs.RemoteDir, inputs.ProjectName)
+	}
+	if strings.Join(inputs.ComposeFiles, ",") != "deploy/docker-compose.yml,deploy/docker-compose.prod.yml" {
+		t.Errorf("loadInputs() compose files = %q", inputs.ComposeFiles)
+	}
+	if strings.Join(inputs.Profiles, ",") != "workers,debug" {
+		t.Errorf("loadInputs() profiles = %q", inputs.Profiles)
+	}
+	if strings.Join(inputs.Services, ",") != "api,worker" || !inputs.NoDeps {
+		t.Errorf("loadInputs() services = %q, no deps = %v", inputs.Services, inputs.NoDeps)
+	}
+	if len(inputs.PostDeploy) != 1 || !inputs.PostDeploy[0].ContinueOnError || len(inputs.PreDeploy) != 0 {
+		t.Errorf("loadInputs() hooks = %+v, %+v", inputs.PreDeploy, inputs.PostDeploy)
+	}
+	if inputs.TransferMethod != TransferAuto || inputs.SSH.Port != 22 {
+		t.Errorf("loadInputs() transfer method = %q, port = %d", inputs.TransferMethod, inputs.SSH.Port)
+	}
+
+	for _, name := range []string{"Web", "-web", "web app"} {
+		t.Setenv("PROJECT_NAME", name)
+		if _, err := loadInputs(); err == nil || !strings.Contains(err.Error(), "invalid project name") {
+			t.Errorf("loadInputs() with project name %q: expected error, got: %v", name, err)
+		}
+	}
+
+	t.Setenv("PROJECT_NAME", "")
+	t.Setenv("SERVICES", "")
+	if _, err := loadInputs(); err == nil || !strings.Contains(err.Error(), "no_deps requires services") {
+		t.Errorf("expected no_deps error, got: %v", err)
+	}
+	t.Setenv("NO_DEPS", "")
+
+	t.Setenv("COMPOSE_FILE", "deploy/docker-compose.yml\nother/docker-compose.yml")
+	if _, err := loadInputs(); err == nil || !strings.Contains(err.Error(), "other/docker-compose.yml") {
+		t.Errorf("expected compose file location error, got: %v", err)
+	}
+
+	t.Setenv("DOCKER_TAG", "")
+	if _, err := loadInputs(); err == nil || !strings.Contains(err.Error(), "DOCKER_TAG") {
+		t.Errorf("expected missing DOCKER_TAG error, got: %v", err)
+	}
+
+	// The rollback mode needs neither a tag nor compose files
+	t.Setenv("MODE", "rollback")
+	t.Setenv("COMPOSE_FILE", "")
+	t.Setenv("ROLLBACK_STEPS", "2")
+	inputs, err = loadInputs()
+	if err != nil {
+		t.Fatalf("loadInputs() in rollback mode returned unexpected error: %v", err)
+	}
+	if inputs.Mode != ModeRollback || inputs.RollbackSteps != 2 || !inputs.AutoRollback {
+		t.Errorf("loadInputs() mode = %q, rollback steps = %d, auto rollback = %v", inputs.Mode, inputs.RollbackSteps, inputs.AutoRollback)
+	}
+	t.Setenv("MODE", "history")
+	t.Setenv("GITHUB_RUN_ID", "42")
+	if inputs, err = loadInputs(); err != nil || inputs.HistoryLimit != 20 || inputs.LockTimeout != 10*time.Minute || inputs.RunID != "42" {
+		t.Errorf("loadInputs() in history mode = %+v, %v", inputs, err)
+	}
+	t.Setenv("KEEP_RELEASES", "0")
+	if _, err := loadInputs(); err == nil || !strings.Contains(err.Error(), "invalid keep releases") {
+		t.Errorf("expected KEEP_RELEASES error, got: %v", err)
+	}
+	t.Setenv("KEEP_RELEASES", "")
+	t.Setenv("MODE", "force_unlock")
+	t.Setenv("LOCK_TIMEOUT", "0")
+	if inputs, err = loadInputs(); err != nil || inputs.Mode != ModeForceUnlock || inputs.LockTimeout != 0 {
+		t.Errorf("loadInputs() in force_unlock mode = %+v, %v", inputs, err)
+	}
+	t.Setenv("MODE", "undo")
+	if _, err := loadInputs(); err == nil || !strings.Contains(err.Error(), "invalid mode") {
+		t.Errorf("expected invalid mode error, got: %v", err)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Deployment uploads the stack into a new release directory, points the
+// current symlink at it and runs docker compose from there
+type Deployment struct {
+	Inputs *Inputs
+	Client *SSHClient
+
+	// composeFiles are the compose files relative to the release directory,
+	// in the order they are passed to docker compose
+	composeFiles []string
+	// services are the services being deployed: the services input, or
+	// every service of the stack
+	services []string
+	// files collects every uploaded file for validation
+	files []fileDigest
+	// env holds the variables written to the .env of the release
+	env []EnvVar
+	// release is the release being deployed; switched is set once current
+	// points to it
+	release  release
+	switched bool
+
+	// lock is the content of the deploy lock while this run holds it
+	lock string
+
+	// tag, composeSHA256 and rolledBack describe the run for the history
+	tag           string
+	composeSHA256 string
+	rolledBack    bool
+}
+
+// remotePath returns rel inside the remote directory
+func (d *Deployment) remotePath(rel string) string {
+	return path.Join(d.Inputs.RemoteDir, rel)
+}
+
+// releasePath returns rel inside the directory of the release being deployed
+func (d *Deployment) releasePath(rel string) string {
+	return path.Join(d.Inputs.RemoteDir, releasesDir, d.release.ID, rel)
+}
+
+// composeRemotePaths maps the compose files to their paths in the release
+// directory. The first file lands at the top and the others keep their
+// location relative to it, so docker compose resolves relative paths the
+// same way as locally.
+func composeRemotePaths(files []string) ([]string, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no compose file given")
+	}
+	baseDir := filepath.Dir(files[0])
+
+	seen := map[string]bool{}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		rel, err := filepath.Rel(baseDir, f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compose file %s: %v", f, err)
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			return nil, fmt.Errorf("compose file %s must be in the directory of %s or below", f, files[0])
+		}
+		if seen[rel] {
+			return nil, fmt.Errorf("compose file %s is listed twice", f)
+		}
+		seen[rel] = true
+		paths[i] = rel
+	}
+	return paths, nil
+}
+
+// composeDir is the directory docker compose runs in, relative to the
+// remote directory: the new release until current is switched to it right
+// before up, current from then on
+func (d *Deployment) composeDir() string {
+	if d.release.ID != "" && !d.switched {
+		return d.release.dir()
+	}
+	return currentLink
+}
+
+// inComposeDir prefixes cmd to run in composeDir. The current symlink is
+// resolved with cd -P so bind mounts refer to the release directory and not
+// to whatever current points to later. Without project_name, $project is
+// set to the name of the remote directory, the project name docker compose
+// used when it ran there.
+func (d *Deployment) inComposeDir(cmd string) string {
+	var script []string
+	if d.Inputs.RemoteDir != "." {
+		script = append(script, "cd "+shellQuote(d.Inputs.RemoteDir))
+	}
+	if d.Inputs.ProjectName == "" {
+		script = append(script, `project=$(basename "$PWD" | tr 'A-Z' 'a-z' | tr -cd 'a-z0-9_-' | sed 's/^[_-]*//')`)
+	}
+	script = append(script, "cd -P "+d.composeDir(), cmd)
+	return strings.Join(script, " && ")
+}
+
+// projectWord returns the compose project name as a shell word for commands
+// wrapped by inComposeDir
+func (d *Deployment) projectWord() string {
+	if d.Inputs.ProjectName == "" {
+		return `"$project"`
+	}
+	return shellQuote(d.Inputs.ProjectName)
+}
+
+// composeCommand builds a docker compose command that runs in composeDir
+// with the configured project name, compose files and profiles.
+// docker replaces the shell via exec, so the SIGTERM sent on timeout or
+// cancellation reaches docker compose instead of only the shell.
+func (d *Deployment) composeCommand(args ...string) string {
+	cmd := []string{"exec", "docker", "compose", "-p", d.projectWord()}
+	for _, f := range d.composeFiles {
+		cmd = append(cmd, "-f", shellQuote(f))
+	}
+	for _, profile := range d.Inputs.Profiles {
+		cmd = append(cmd, "--profile", shellQuote(profile))
+	}
+	cmd = append(cmd, args...)
+	return d.inComposeDir(strings.Join(cmd, " "))
+}
+
+// Run deploys the stack as a new release. When the deploy fails after
+// current was switched to it, the previous release is restored.
+func (d *Deployment) Run(ctx context.Context) error {
+	d.tag = d.Inputs.DockerTag
+	composeFiles, err := composeRemotePaths(d.Inputs.ComposeFiles)
+	if err != nil {
+		return err
+	}
+	d.composeFiles = composeFiles
+
+	// Create the releases directory before anything is uploaded to it
+	releases := d.remotePath(releasesDir)
+	if result, err := d.Client.RunCommand(ctx, fmt.Sprintf("mkdir -p %s", shellQuote(releases))); err != nil {
+		return fmt.Errorf("failed to create remote directory %s: %v\nOutput: %s", releases, err, result.Output())
+	}
+	log(fmt.Sprintf("Using remote directory %s", d.Inputs.RemoteDir))
+
+	previous, err := d.recordPrevious(ctx)
+	if err != nil {
+		return err
+	}
+	d.release, d.switched = newRelease(d.Inputs.DockerTag, time.Now()), false
+
+	if err := d.deploy(ctx); err != nil {
+		if d.switched && previous != nil && d.Inputs.AutoRollback {
+			err = d.rollbackAfter(ctx, err, previous)
+		} else if outErr := setOutput("rolled_back", "false"); outErr != nil {
+			logWarning(outErr.Error())
+		}
+		// Keep the failed release only while current points to it. The
+		// history does not refer to a removed release.
+		if (!d.switched || d.rolledBack) && d.removeRelease(ctx, d.release) {
+			d.release = release{}
+		}
+		return err
+	}
+
+	if err := d.pruneReleases(ctx); err != nil {
+		logWarning(fmt.Sprintf("Failed to remove old releases: %v", err))
+	}
+	return setOutput("rolled_back", "false")
+}
+
+// deploy uploads and validates the files of the new release and pulls its
+// images from there, then switches current to it, starts the stack and
+// checks that it is up. Failures before the switch leave the live release
+// untouched.
+func (d *Deployment) deploy(ctx context.Context) error {
+	if err := d.transferFiles(ctx); err != nil {
+		return err
+	}
+
+	if err := d.checkServices(ctx); err != nil {
+		return err
+	}
+
+	// Run docker compose pull
+	services := quoteAll(d.Inputs.Services)
+	log("Running docker compose pull...")
+	if result, err := d.Client.StreamCommand(ctx, d.composeCommand(append([]string{"pull"}, services...)...)); err != nil {
+		return commandError("docker compose pull", result, err)
+	}
+	log("Successfully pulled Docker images")
+
+	if err := d.runHooks(ctx, "pre_deploy", d.Inputs.PreDeploy); err != nil {
+		return err
+	}
+
+	if err := d.activate(ctx, d.release, d.composeFiles); err != nil {
+		return err
+	}
+	d.switched = true
+
+	// Run docker compose up -d
+	up := []string{"up", "-d"}
+	if d.Inputs.NoDeps {
+		up = append(up, "--no-deps")
+	}
+	log(fmt.Sprintf("Running docker compose %s...", strings.Join(append(up, d.Inputs.Services...), " ")))
+	if result, err := d.Client.StreamCommand(ctx, d.composeCommand(append(up, services...)...)); err != nil {
+		return commandError("docker compose up", result, err)
+	}
+	log("Successfully started Docker containers")
+
+	if d.Inputs.WaitTimeout > 0 && len(d.services) > 0 {
+		if err := d.waitHealthy(ctx, d.services, d.Inputs.WaitTimeout); err != nil {
+			return err
+		}
+	}
+
+	if err := d.runHooks(ctx, "post_deploy", d.Inputs.PostDeploy); err != nil {
+		return err
+	}
+
+	if len(d.Inputs.SmokeChecks) > 0 {
+		if err := d.runSmokeChecks(ctx, d.Inputs.SmokeChecks, d.Inputs.SmokeRetries, d.Inputs.SmokeTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkServices lets docker compose validate the merged configuration before
+// anything is pulled, and makes sure every requested service is defined
+func (d *Deployment) checkServices(ctx context.Context) error {
+	stack, err := d.stackServices(ctx)
+	if err != nil {
+		return err
+	}
+	defined := map[string]bool{}
+	for _, service := range stack {
+		defined[service] = true
+	}
+
+	var missing []string
+	for _, service := range d.Inputs.Services {
+		if !defined[service] {
+			missing = append(missing, service)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("services not defined in %s: %s", strings.Join(d.composeFiles, ", "), strings.Join(missing, ", "))
+	}
+
+	d.services = d.Inputs.Services
+	if len(d.services) == 0 {
+		d.services = stack
+	}
+
+	log(fmt.Sprintf("Validated docker compose configuration: %s", strings.Join(d.composeFiles, ", ")))
+	if len(d.Inputs.Services) > 0 {
+		log(fmt.Sprintf("Deploying services: %s", strings.Join(d.Inputs.Services, ", ")))
+	}
+	return nil
+}
+
+// stackServices lists the services of the stack, which also has docker
+// compose validate the merged configuration
+func (d *Deployment) stackServices(ctx context.Context) ([]string, error) {
+	result, err := d.Client.RunCommand(ctx, d.composeCommand("config", "--services"))
+	if err != nil {
+		return nil, commandError("docker compose config", result, err)
+	}
+	return strings.Fields(result.Stdout), nil
+}
+
+// quoteAll shell quotes every argument
+func quoteAll(args []string) []string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return quoted
+}
+
+// transferFiles uploads the .env, compose and extra files, validates their
+// checksums on the remote host and sets the checksum outputs
+func (d *Deployment) transferFiles(ctx context.Context) error {
+	d.files = nil
+
+	// Build the .env file in memory so secrets never touch the runner's
+	// disk. In merge mode variables the action does not manage are kept.
+	managed := d.managedEnv()
+	vars := managed
+	if d.Inputs.EnvMode == EnvMerge {
+		existing, err := d.readRemoteEnv(ctx)
+		if err != nil {
+			return err
+		}
+		vars = mergeEnv(existing, managed)
+		log(fmt.Sprintf("Merging into remote .env (values redacted):\n  %s", strings.Join(envDiff(existing, managed), "\n  ")))
+	}
+
+	// Upload it readable only by the deploy user
+	envContent := renderEnv(vars)
+	envDigest := sha256Hex(envContent)
+	remoteEnvFile := d.releasePath(".env")
+	if err := d.Client.TransferBytes(ctx, envContent, remoteEnvFile, 0600); err != nil {
+		return fmt.Errorf("failed to transfer .env file: %v", err)
+	}
+	d.files = append(d.files, fileDigest{RemotePath: remoteEnvFile, SHA256: envDigest})
+	d.env = vars
+	log(fmt.Sprintf("Successfully transferred .env file with %d variables: %s", len(vars), strings.Join(envKeys(vars), ", ")))
+
+	// Transfer docker-compose files
+	var composeDigest string
+	for i, localPath := range d.Inputs.ComposeFiles {
+		remoteComposeFile := d.releasePath(d.composeFiles[i])
+		digest, err := d.transfer(ctx, localPath, remoteComposeFile)
+		if err != nil {
+			return fmt.Errorf("failed to transfer docker-compose file: %v", err)
+		}
+		if i == 0 {
+			composeDigest = digest
+			d.composeSHA256 = digest
+		}
+		log(fmt.Sprintf("Successfully transferred docker-compose file: %s", remoteComposeFile))
+	}
+
+	// Transfer extra files and directories next to the docker-compose file
+	if len(d.Inputs.ExtraFiles) > 0 {
+		transferred, err := transferExtraFiles(ctx, d.Client, filepath.Dir(d.Inputs.ComposeFiles[0]), d.releasePath(""), d.Inputs.ExtraFiles)
+		if err != nil {
+			return fmt.Errorf("failed to transfer extra files: %v", err)
+		}
+
+		var summary strings.Builder
+		var total int64
+		for _, f := range transferred {
+			fmt.Fprintf(&summary, "\n  %s (%04o, %s)", f.RemotePath, f.Mode, formatSize(f.Size))
+			total += f.Size
+			digest, err := localSHA256(f.LocalPath)
+			if err != nil {
+				return err
+			}
+			d.files = append(d.files, fileDigest{RemotePath: f.RemotePath, SHA256: digest})
+		}
+		log(fmt.Sprintf("Successfully transferred %d extra files (%s):%s", len(transferred), formatSize(total), summary.String()))
+	}
+
+	// Validate transferred files against their local SHA-256 digests
+	if err := validateFiles(ctx, d.Client, d.files...); err != nil {
+		return fmt.Errorf("file validation failed: %v", err)
+	}
+	var validated []string
+	for _, f := range d.files {
+		validated = append(validated, fmt.Sprintf("%s (sha256:%s)", f.RemotePath, f.SHA256))
+	}
+	log(fmt.Sprintf("Successfully validated files:\n  %s", strings.Join(validated, "\n  ")))
+
+	checksums, err := checksumsJSON(d.files)
+	if err != nil {
+		return err
+	}
+	for name, value := range map[string]string{
+		"env_sha256":     envDigest,
+		"compose_sha256": composeDigest,
+		"checksums":      checksums,
+	} {
+		if err := setOutput(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// managedEnv returns the variables the action writes to .env: DOCKER_TAG
+// followed by env_file and env
+func (d *Deployment) managedEnv() []EnvVar {
+	return append([]EnvVar{{Key: "DOCKER_TAG", Value: d.Inputs.DockerTag}}, d.Inputs.Env...)
+}
+
+// readRemoteEnv parses the .env of the current release, or the .env in the
+// remote directory on hosts deployed before releases; a missing file has no
+// variables. Unparseable files are reported instead of being dropped.
+func (d *Deployment) readRemoteEnv(ctx context.Context) ([]EnvVar, error) {
+	envFile := path.Join(currentLink, ".env")
+	result, err := d.Client.RunCommand(ctx, d.inRemoteDir(fmt.Sprintf("if [ -e %[1]s ]; then cat %[1]s; elif [ -e .env ]; then cat .env; fi", envFile)))
+	if err != nil {
+		return nil, commandError("cat .env", result, err)
+	}
+	vars, err := parseEnv(result.Stdout)
+	if err != nil {
+		return nil, fmt.Errorf("remote .env cannot be merged: %v", err)
+	}
+	return vars, nil
+}
+
+// transfer uploads a local file and records its digest for validation
+func (d *Deployment) transfer(ctx context.Context, localPath, remotePath string) (string, error) {
+	digest, err := localSHA256(localPath)
+	if err != nil {
+		return "", err
+	}
+	if err := d.Client.TransferFileWithRemotePath(ctx, localPath, remotePath); err != nil {
+		return "", err
+	}
+	d.files = append(d.files, fileDigest{RemotePath: remotePath, SHA256: digest})
+	return digest, nil
+}
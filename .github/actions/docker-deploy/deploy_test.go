@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeDocker puts a docker script on PATH for the commands run by the test
+// SSH server. By default it logs its working directory and arguments to the
+// returned file.
+func fakeDocker(t *testing.T, script string) string {
+	t.Helper()
+	bin := t.TempDir()
+	logFile := filepath.Join(bin, "docker.log")
+	if script == "" {
+		script = `echo "$PWD $*" >> "$DOCKER_LOG"`
+	}
+	if err := os.WriteFile(filepath.Join(bin, "docker"), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatalf("failed to write fake docker: %v", err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("DOCKER_LOG", logFile)
+	return logFile
+}
+
+func TestComposeCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		inputs Inputs
+		want   string
+	}{
+		{
+			name:   "home",
+			inputs: Inputs{ComposeFiles: []string{"deploy/docker-compose.yml"}, RemoteDir: "."},
+			want:   "project=$(basename \"$PWD\" | tr 'A-Z' 'a-z' | tr -cd 'a-z0-9_-' | sed 's/^[_-]*//') && cd -P current && exec docker compose -p \"$project\" -f 'docker-compose.yml' pull",
+		},
+		{
+			name:   "remote_dir_and_project",
+			inputs: Inputs{ComposeFiles: []string{"docker-compose.yml"}, RemoteDir: "/srv/my app", ProjectName: "web"},
+			want:   "cd '/srv/my app' && cd -P current && exec docker compose -p 'web' -f 'docker-compose.yml' pull",
+		},
+		{
+			name: "overrides_and_profiles",
+			inputs: Inputs{
+				ComposeFiles: []string{"deploy/docker-compose.yml", "deploy/prod/override.yml"},
+				Profiles:     []string{"workers", "debug"},
+				RemoteDir:    ".",
+			},
+			want: "project=$(basename \"$PWD\" | tr 'A-Z' 'a-z' | tr -cd 'a-z0-9_-' | sed 's/^[_-]*//') && cd -P current && exec docker compose -p \"$project\" -f 'docker-compose.yml' -f 'prod/override.yml' --profile 'workers' --profile 'debug' pull",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			composeFiles, err := composeRemotePaths(tt.inputs.ComposeFiles)
+			if err != nil {
+				t.Fatalf("composeRemotePaths() returned unexpected error: %v", err)
+			}
+			d := &Deployment{Inputs: &tt.inputs, composeFiles: composeFiles}
+			if got := d.composeCommand("pull"); got != tt.want {
+				t.Errorf("composeCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComposeCommandTimeout(t *testing.T) {
+	server, client := newTestClient(t)
+	client.CommandTimeout = 200 * time.Millisecond
+	pidFile := fakeDocker(t, `echo $$ > "$DOCKER_LOG"; exec sleep 30`)
+	if err := os.Mkdir(filepath.Join(server.Dir, currentLink), 0755); err != nil {
+		t.Fatalf("failed to create release directory: %v", err)
+	}
+
+	// docker compose itself gets the SIGTERM, not just the shell running it
+	d := &Deployment{Inputs: &Inputs{RemoteDir: ".", ProjectName: "web"}, Client: client, composeFiles: []string{"docker-compose.yml"}}
+	if _, err := client.RunCommand(context.Background(), d.composeCommand("pull")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RunCommand() error = %v, want timeout", err)
+	}
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("docker was not run: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("invalid pid %q", data)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatal("docker compose kept running after the command timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestComposeRemotePathsErrors(t *testing.T) {
+	for _, files := range [][]string{
+		nil,
+		{"deploy/docker-compose.yml", "other/override.yml"},
+		{"docker-compose.yml", "./docker-compose.yml"},
+	} {
+		if _, err := composeRemotePaths(files); err == nil {
+			t.Errorf("composeRemotePaths(%q) should return error", files)
+		}
+	}
+}
+
+func TestDeploymentRun(t *testing.T) {
+	server, client := newTestClient(t)
+	dockerLog := fakeDocker(t, "")
+	t.Setenv("GITHUB_OUTPUT", "")
+
+	local := t.TempDir()
+	composeFile := filepath.Join(local, "docker-compose.yml")
+	writeTestFiles(t, local, map[string]os.FileMode{
+		"docker-compose.yml": 0644,
+		"prod/override.yml":  0644,
+		"nginx/default.conf": 0644,
+	})
+
+	d := &Deployment{
+		Inputs: &Inputs{
+			ComposeFiles: []string{composeFile, filepath.Join(local, "prod", "override.yml")},
+			Profiles:     []string{"workers"},
+			DockerTag:    "abc1234",
+			ExtraFiles:   []string{"nginx"},
+			RemoteDir:    "stacks/web",
+			ProjectName:  "web",
+			Env:          []EnvVar{{Key: "GREETING", Value: "hello world"}},
+		},
+		Client: client,
+	}
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+
+	// Everything lands in the release directory current points to
+	current := filepath.Join(server.Dir, "stacks", "web", "current")
+	if fi, err := os.Lstat(current); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("current is not a symlink: %v", err)
+	}
+	releaseDir, err := filepath.EvalSymlinks(current)
+	if err != nil {
+		t.Fatalf("current does not resolve: %v", err)
+	}
+	if !strings.HasSuffix(filepath.Base(releaseDir), "Z-abc1234") {
+		t.Errorf("current points to %s, want a release of abc1234", releaseDir)
+	}
+	for _, name := range []string{".env", "docker-compose.yml", "prod/override.yml", "nginx/default.conf", releaseComposeList} {
+		if _, err := os.Stat(filepath.Join(releaseDir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("expected %s in the release directory: %v", name, err)
+		}
+	}
+
+	if got, _ := os.ReadFile(filepath.Join(releaseDir, ".env")); string(got) != "DOCKER_TAG=abc1234\nGREETING='hello world'\n" {
+		t.Errorf(".env = %q", got)
+	}
+	if fi, err := os.Stat(filepath.Join(releaseDir, ".env")); err == nil && fi.Mode().Perm() != 0600 {
+		t.Errorf(".env mode = %04o, want 0600", fi.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(dockerLog)
+	if err != nil {
+		t.Fatalf("docker was not run: %v", err)
+	}
+	// Validation, pull and up all use the same files and profiles
+	compose := releaseDir + " compose -p web -f docker-compose.yml -f prod/override.yml --profile workers"
+	want := []string{compose + " config --services", compose + " pull", compose + " up -d"}
+	if got := strings.Split(strings.TrimSpace(string(data)), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("docker invocations = %q, want %q", got, want)
+	}
+}
+
+func TestDeploymentRunServices(t *testing.T) {
+	healthPollInterval = time.Millisecond
+	t.Cleanup(func() { healthPollInterval = 2 * time.Second })
+
+	_, client := newTestClient(t)
+	dockerLog := fakeDocker(t, `echo "$PWD $*" >> "$DOCKER_LOG"
+case "$*" in
+*"config --services") printf 'api\nredis\n' ;;
+*"ps -a -q api") echo c0ffee ;;
+"inspect --format "*" c0ffee") echo "api running healthy 0 0" ;;
+esac`)
+	t.Setenv("GITHUB_OUTPUT", "")
+
+	local := t.TempDir()
+	writeTestFiles(t, local, map[string]os.FileMode{"docker-compose.yml": 0644})
+
+	d := &Deployment{
+		Inputs: &Inputs{
+			ComposeFiles: []string{filepath.Join(local, "docker-compose.yml")},
+			Services:     []string{"api"},
+			NoDeps:       true,
+			WaitTimeout:  time.Minute,
+			DockerTag:    "abc1234",
+			RemoteDir:    ".",
+		},
+		Client: client,
+	}
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(dockerLog)
+	if err != nil {
+		t.Fatalf("docker was not run: %v", err)
+	}
+	for _, want := range []string{" -f docker-compose.yml pull api\n", " -f docker-compose.yml up -d --no-deps api\n", "inspect --format"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("docker invocations = %q, want %q", data, want)
+		}
+	}
+
+	// Unknown services fail before anything is pulled
+	os.Remove(dockerLog)
+	d.Inputs.Services = []string{"api", "worker"}
+	if err := d.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "services not defined in docker-compose.yml: worker") {
+		t.Errorf("Run() error = %v, want undefined service error", err)
+	}
+	if data, _ := os.ReadFile(dockerLog); strings.Contains(string(data), "pull") {
+		t.Errorf("docker compose pull ran for an undefined service: %q", data)
+	}
+}
+
+func TestDeploymentRunComposeFailure(t *testing.T) {
+	_, client := newTestClient(t)
+	client.logOutput = io.Discard
+	fakeDocker(t, `case "$*" in *config*) exit 0;; esac; echo "Pulling web" ; echo "pull access denied for web" >&2; exit 18`)
+	t.Setenv("GITHUB_OUTPUT", "")
+
+	local := t.TempDir()
+	writeTestFiles(t, local, map[string]os.FileMode{"docker-compose.yml": 0644})
+
+	d := &Deployment{
+		Inputs: &Inputs{ComposeFiles: []string{filepath.Join(local, "docker-compose.yml")}, DockerTag: "abc1234", RemoteDir: "."},
+		Client: client,
+	}
+	err := d.Run(context.Background())
+	if err == nil {
+		t.Fatal("expected error when docker compose pull fails")
+	}
+	for _, want := range []string{"docker compose pull: exit code 18", "\n  pull access denied for web"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Run() error = %q, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestDeploymentMergeEnv(t *testing.T) {
+	server, client := newTestClient(t)
+	fakeDocker(t, "")
+	t.Setenv("GITHUB_OUTPUT", "")
+
+	local := t.TempDir()
+	writeTestFiles(t, local, map[string]os.FileMode{"docker-compose.yml": 0644})
+	legacyEnv := filepath.Join(server.Dir, ".env")
+	remoteEnv := filepath.Join(server.Dir, "current", ".env")
+
+	d := &Deployment{
+		Inputs: &Inputs{
+			ComposeFiles: []string{filepath.Join(local, "docker-compose.yml")},
+			DockerTag:    "new1234",
+			RemoteDir:    ".",
+			Env:          []EnvVar{{Key: "FEATURE", Value: "on"}},
+			EnvMode:      EnvMerge,
+		},
+		Client: client,
+	}
+
+	// Host-specific values survive, managed keys are updated in place
+	if err := os.WriteFile(legacyEnv, []byte("# set by ops\nDB_PASSWORD='pa ss'\nDOCKER_TAG=old1234\n"), 0600); err != nil {
+		t.Fatalf("failed to write remote .env: %v", err)
+	}
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+	want := "DB_PASSWORD='pa ss'\nDOCKER_TAG=new1234\nFEATURE=on\n"
+	if got, _ := os.ReadFile(remoteEnv); string(got) != want {
+		t.Errorf("merged .env = %q, want %q", got, want)
+	}
+
+	// A live .env that cannot be parsed is left alone
+	broken := "DB_PASSWORD=\"unterminated\n"
+	if err := os.WriteFile(remoteEnv, []byte(broken), 0600); err != nil {
+		t.Fatalf("failed to write remote .env: %v", err)
+	}
+	if err := d.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "cannot be merged") {
+		t.Errorf("Run() error = %v, want merge error", err)
+	}
+	if got, _ := os.ReadFile(remoteEnv); string(got) != broken {
+		t.Errorf("remote .env changed after failed merge: %q", got)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// keepaliveMaxMissed is how many unanswered keepalives close the
+	// connection, like OpenSSH's ServerAliveCountMax
+	keepaliveMaxMissed = 3
+	maxRetryDelay      = 30 * time.Second
+)
+
+// retryBaseDelay is the delay before the first retry, doubled on every attempt
+var retryBaseDelay = time.Second
+
+// errHandshakeTimeout is returned when a hop does not finish its SSH
+// handshake within the connect timeout
+var errHandshakeTimeout = errors.New("ssh handshake timed out")
+
+// dialChain connects to every jump host in order and finally to the target,
+// closing any opened connections on failure
+func dialChain(ctx context.Context, hops []SSHConfig, hopConfigs []*ssh.ClientConfig, target SSHConfig, config *ssh.ClientConfig) (*ssh.Client, []*ssh.Client, error) {
+	var jumps []*ssh.Client
+	closeJumps := func() {
+		for i := len(jumps) - 1; i >= 0; i-- {
+			jumps[i].Close()
+		}
+	}
+
+	for i, hop := range append(hops, target) {
+		hopConfig := config
+		if i < len(hops) {
+			hopConfig = hopConfigs[i]
+		}
+
+		var conn net.Conn
+		var err error
+		if len(jumps) == 0 {
+			dialer := net.Dialer{Timeout: hop.ConnectTimeout}
+			conn, err = dialer.DialContext(ctx, "tcp", hop.Addr())
+		} else {
+			conn, err = jumps[len(jumps)-1].DialContext(ctx, "tcp", hop.Addr())
+		}
+
+		var client *ssh.Client
+		if err == nil {
+			client, err = newClientConn(ctx, conn, hop.Addr(), hopConfig, hop.ConnectTimeout)
+		}
+		if err != nil {
+			closeJumps()
+			if i < len(hops) {
+				return nil, nil, fmt.Errorf("failed to dial jump host %s: %w", hop.Addr(), err)
+			}
+			return nil, nil, fmt.Errorf("failed to dial: %w", err)
+		}
+
+		if i == len(hops) {
+			return client, jumps, nil
+		}
+		jumps = append(jumps, client)
+	}
+	return nil, nil, nil // unreachable, the target is always the last hop
+}
+
+// newClientConn runs the SSH handshake over conn, giving up after timeout or
+// when ctx is cancelled
+func newClientConn(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() { conn.Close() })
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if !stop() {
+		// The context was cancelled and closed the connection
+		if err == nil {
+			c.Close()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		return nil, ctx.Err()
+	}
+	if timer != nil && !timer.Stop() {
+		// The timer fired and closed the connection
+		if err == nil {
+			c.Close()
+		}
+		return nil, fmt.Errorf("%w after %s", errHandshakeTimeout, timeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// isTransientError reports whether a connection error is worth retrying.
+// Only network level failures qualify; authentication and host key errors
+// never do.
+func isTransientError(err error) bool {
+	if errors.Is(err, errHandshakeTimeout) {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	for _, target := range []error{
+		syscall.ECONNREFUSED,
+		syscall.ECONNRESET,
+		syscall.ECONNABORTED,
+		syscall.EHOSTUNREACH,
+		syscall.ENETUNREACH,
+		syscall.EPIPE,
+		io.EOF,
+		io.ErrUnexpectedEOF,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryDelay returns an exponential backoff with jitter for the given
+// attempt (starting at 1): a random delay between half and the full backoff
+func retryDelay(attempt int) time.Duration {
+	backoff := retryBaseDelay << (attempt - 1)
+	if backoff > maxRetryDelay || backoff <= 0 {
+		backoff = maxRetryDelay
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// keepalive sends keepalive requests every interval until the client is
+// closed. The connection is closed when the server stops answering, so a
+// dead link fails running commands instead of hanging them.
+func (s *SSHClient) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := s.client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-s.done:
+			return
+		case err := <-reply:
+			if err != nil {
+				return // connection already closed
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			if missed >= keepaliveMaxMissed {
+				logWarning(fmt.Sprintf("No keepalive response for %s, closing connection", time.Duration(missed)*interval))
+				s.client.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// countingProxy forwards connections to target (or closes them when target
+// is empty) and counts how many were accepted
+type countingProxy struct {
+	listener net.Listener
+	count    atomic.Int32
+}
+
+func newCountingProxy(t testing.TB, target string, hold bool) *countingProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	p := &countingProxy{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			p.count.Add(1)
+			switch {
+			case target != "":
+				go func() {
+					upstream, err := net.Dial("tcp", target)
+					if err != nil {
+						conn.Close()
+						return
+					}
+					go io.Copy(upstream, conn)
+					io.Copy(conn, upstream)
+					conn.Close()
+					upstream.Close()
+				}()
+			case hold:
+				// Accept but never answer, simulating a hung server
+				t.Cleanup(func() { conn.Close() })
+			default:
+				conn.Close()
+			}
+		}
+	}()
+	return p
+}
+
+func (p *countingProxy) Port() int {
+	return p.listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "refused", err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "reset", err: fmt.Errorf("failed to dial: %w", syscall.ECONNRESET), want: true},
+		{name: "eof_during_handshake", err: fmt.Errorf("ssh: handshake failed: %w", io.EOF), want: true},
+		{name: "handshake_timeout", err: fmt.Errorf("failed to dial: %w after 1s", errHandshakeTimeout), want: true},
+		{name: "dns_temporary", err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}, want: true},
+		{name: "dns_not_found", err: &net.DNSError{Err: "no such host", IsNotFound: true}, want: false},
+		{name: "auth", err: errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey]"), want: false},
+		{name: "host_key", err: fmt.Errorf("ssh: handshake failed: %w", errors.New("host key verification failed")), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientError(tt.err); got != tt.want {
+				t.Errorf("isTransientError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		backoff := retryBaseDelay << (attempt - 1)
+		if backoff > maxRetryDelay {
+			backoff = maxRetryDelay
+		}
+		for i := 0; i < 20; i++ {
+			d := retryDelay(attempt)
+			if d < backoff/2 || d > backoff {
+				t.Fatalf("retryDelay(%d) = %s, want between %s and %s", attempt, d, backoff/2, backoff)
+			}
+		}
+	}
+}
+
+func TestCreateSSHClientRetries(t *testing.T) {
+	origDelay := retryBaseDelay
+	retryBaseDelay = time.Millisecond
+	defer func() { retryBaseDelay = origDelay }()
+
+	server := newTestSSHServer(t)
+
+	// Connections closed before the handshake are retried
+	closing := newCountingProxy(t, "", false)
+	cfg := server.testSSHConfig(t)
+	cfg.Port = closing.Port()
+	cfg.Retries = 2
+	if _, err := CreateSSHClient(context.Background(), cfg); err == nil {
+		t.Fatal("expected error when the server closes connections")
+	}
+	if got := closing.count.Load(); got != 3 {
+		t.Errorf("expected 3 connection attempts, got %d", got)
+	}
+
+	// Authentication failures are not retried
+	proxy := newCountingProxy(t, server.Addr, false)
+	cfg = server.testSSHConfig(t)
+	cfg.User = "nobody"
+	cfg.Port = proxy.Port()
+	cfg.KnownHosts = strings.Replace(server.KnownHosts(), fmt.Sprint(server.Port()), fmt.Sprint(proxy.Port()), 1)
+	cfg.Retries = 2
+	_, err := CreateSSHClient(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+		t.Fatalf("expected authentication error, got: %v", err)
+	}
+	if got := proxy.count.Load(); got != 1 {
+		t.Errorf("expected a single connection attempt for auth failure, got %d", got)
+	}
+}
+
+func TestCreateSSHClientHandshakeTimeout(t *testing.T) {
+	hung := newCountingProxy(t, "", true)
+	server := newTestSSHServer(t)
+
+	cfg := server.testSSHConfig(t)
+	cfg.Port = hung.Port()
+	cfg.ConnectTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := CreateSSHClient(context.Background(), cfg)
+	if !errors.Is(err, errHandshakeTimeout) {
+		t.Fatalf("expected handshake timeout, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("handshake timeout took %s", elapsed)
+	}
+}
+
+func TestSSHClientKeepalive(t *testing.T) {
+	server := newTestSSHServer(t)
+	cfg := server.testSSHConfig(t)
+	cfg.KeepaliveInterval = 10 * time.Millisecond
+
+	client, err := CreateSSHClient(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("CreateSSHClient() returned unexpected error: %v", err)
+	}
+	defer client.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := client.RunCommand(context.Background(), "true"); err != nil {
+		t.Errorf("connection should stay usable with keepalives, got: %v", err)
+	}
+}
+
+func TestCreateSSHClientCancel(t *testing.T) {
+	hung := newCountingProxy(t, "", true)
+	server := newTestSSHServer(t)
+
+	cfg := server.testSSHConfig(t)
+	cfg.Port = hung.Port()
+	cfg.ConnectTimeout = time.Minute
+	cfg.Retries = 3
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := CreateSSHClient(ctx, cfg)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled connect took %s", elapsed)
+	}
+	if got := hung.count.Load(); got != 1 {
+		t.Errorf("expected no retries after cancellation, got %d attempts", got)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// EnvVar is a single variable of the generated .env file
+type EnvVar struct {
+	Key   string
+	Value string
+}
+
+// Env modes for an existing remote .env
+const (
+	EnvReplace = "replace" // write only the managed variables
+	EnvMerge   = "merge"   // keep variables the action does not manage
+)
+
+var (
+	envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// safeEnvValue matches values written without quotes
+	safeEnvValue = regexp.MustCompile(`^[A-Za-z0-9_./:@,+-]*$`)
+)
+
+// loadEnv merges the env_file and env inputs: env overrides env_file, and
+// DOCKER_TAG is reserved for the docker_tag input
+func loadEnv(envFile, env string) ([]EnvVar, error) {
+	var fromFile []EnvVar
+	if path := strings.TrimSpace(envFile); path != "" {
+		data, err := os.ReadFile(resolveWorkspacePath(path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read env_file: %v", err)
+		}
+		if fromFile, err = parseEnv(string(data)); err != nil {
+			return nil, fmt.Errorf("invalid env_file %s: %v", path, err)
+		}
+	}
+
+	fromInput, err := parseEnv(env)
+	if err != nil {
+		return nil, fmt.Errorf("invalid env: %v", err)
+	}
+
+	var vars []EnvVar
+	for _, v := range mergeEnv(fromFile, fromInput) {
+		if v.Key == "DOCKER_TAG" {
+			logWarning("Ignoring DOCKER_TAG from env/env_file, it is set by docker_tag")
+			continue
+		}
+		vars = append(vars, v)
+	}
+	return vars, nil
+}
+
+// parseEnv parses .env syntax: KEY=VALUE lines with an optional "export "
+// prefix, # comments and blank lines. Values may be single quoted (literal)
+// or double quoted (with \n, \t, \", \\ and \$ escapes); both may span lines.
+// Errors never include values, which may be secrets.
+func parseEnv(content string) ([]EnvVar, error) {
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+
+	var vars []EnvVar
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimLeft(lines[i], " \t")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !envKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNo)
+		}
+
+		value = strings.TrimLeft(value, " \t")
+		if value == "" || (value[0] != '"' && value[0] != '\'') {
+			// Unquoted values end at a " #" comment
+			if j := strings.Index(value, " #"); j >= 0 {
+				value = value[:j]
+			}
+			vars = mergeEnv(vars, []EnvVar{{Key: key, Value: strings.TrimSpace(value)}})
+			continue
+		}
+
+		// Collect lines until the closing quote
+		quote := value[0]
+		body := value[1:]
+		for {
+			if end := closingQuote(body, quote); end >= 0 {
+				if rest := strings.TrimSpace(body[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+					return nil, fmt.Errorf("line %d: unexpected characters after the quoted value of %s", i+1, key)
+				}
+				body = body[:end]
+				break
+			}
+			i++
+			if i >= len(lines) {
+				return nil, fmt.Errorf("line %d: unterminated quoted value for %s", lineNo, key)
+			}
+			body += "\n" + lines[i]
+		}
+		if quote == '"' {
+			body = unescapeEnvValue(body)
+		}
+		vars = mergeEnv(vars, []EnvVar{{Key: key, Value: body}})
+	}
+	return vars, nil
+}
+
+// closingQuote returns the index of the unescaped closing quote in s, or -1
+func closingQuote(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote == '"':
+			i++
+		case s[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// unescapeEnvValue resolves the escapes of a double quoted value
+func unescapeEnvValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '"', '\\', '$':
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// mergeEnv applies overrides in order: existing keys keep their position
+// and take the new value, new keys are appended
+func mergeEnv(base []EnvVar, overrides ...[]EnvVar) []EnvVar {
+	merged := append([]EnvVar(nil), base...)
+	index := make(map[string]int, len(merged))
+	for i, v := range merged {
+		index[v.Key] = i
+	}
+	for _, vars := range overrides {
+		for _, v := range vars {
+			if i, ok := index[v.Key]; ok {
+				merged[i].Value = v.Value
+				continue
+			}
+			index[v.Key] = len(merged)
+			merged = append(merged, v)
+		}
+	}
+	return merged
+}
+
+// formatEnvValue quotes a value so docker compose reads it back unchanged.
+// Single quotes keep $ from being interpolated; values containing quotes or
+// newlines are double quoted with escapes.
+func formatEnvValue(value string) string {
+	if safeEnvValue.MatchString(value) {
+		return value
+	}
+	if !strings.ContainsAny(value, "'\n\r") {
+		return "'" + value + "'"
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`)
+	return `"` + r.Replace(value) + `"`
+}
+
+// renderEnv writes the variables in .env syntax
+func renderEnv(vars []EnvVar) []byte {
+	var b strings.Builder
+	for _, v := range vars {
+		fmt.Fprintf(&b, "%s=%s\n", v.Key, formatEnvValue(v.Value))
+	}
+	return []byte(b.String())
+}
+
+// envKeys lists the variable names, for logging without values
+func envKeys(vars []EnvVar) []string {
+	keys := make([]string, len(vars))
+	for i, v := range vars {
+		keys[i] = v.Key
+	}
+	return keys
+}
+
+// maskEnv registers every value with the runner so it is redacted from the
+// job log. Multi-line values are masked line by line, as the runner matches
+// single lines.
+func maskEnv(vars []EnvVar) {
+	for _, v := range vars {
+		for _, line := range strings.Split(v.Value, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				fmt.Printf("::add-mask::%s\n", line)
+			}
+		}
+	}
+}
+
+// envDiff describes, without values, how applying managed to existing
+// changes each key: added, changed, unchanged, or kept when not managed
+func envDiff(existing, managed []EnvVar) []string {
+	current := make(map[string]string, len(existing))
+	for _, v := range existing {
+		current[v.Key] = v.Value
+	}
+	isManaged := make(map[string]bool, len(managed))
+
+	var lines []string
+	for _, v := range managed {
+		isManaged[v.Key] = true
+		old, ok := current[v.Key]
+		switch {
+		case !ok:
+			lines = append(lines, "+ "+v.Key+" (added)")
+		case old != v.Value:
+			lines = append(lines, "~ "+v.Key+" (changed)")
+		default:
+			lines = append(lines, "= "+v.Key+" (unchanged)")
+		}
+	}
+	for _, v := range existing {
+		if !isManaged[v.Key] {
+			lines = append(lines, "  "+v.Key+" (kept)")
+		}
+	}
+	return lines
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []EnvVar
+		wantErr string
+	}{
+		{
+			name:    "plain",
+			content: "# database\nDB_HOST=db\r\nexport DB_PORT = 5432\n\nEMPTY=\n",
+			want:    []EnvVar{{"DB_HOST", "db"}, {"DB_PORT", "5432"}, {"EMPTY", ""}},
+		},
+		{
+			name:    "unquoted_comment_and_equals",
+			content: "URL=postgres://u:p@db/app?sslmode=disable # primary\nHASH=abc#def\n",
+			want:    []EnvVar{{"URL", "postgres://u:p@db/app?sslmode=disable"}, {"HASH", "abc#def"}},
+		},
+		{
+			name:    "single_quoted",
+			content: "GREETING='hello  world # not a comment'\nPRICE='$5'\n",
+			want:    []EnvVar{{"GREETING", "hello  world # not a comment"}, {"PRICE", "$5"}},
+		},
+		{
+			name:    "double_quoted_escapes",
+			content: `MSG="say \"hi\"\tnow\\n" # comment` + "\n",
+			want:    []EnvVar{{"MSG", "say \"hi\"\tnow\\n"}},
+		},
+		{
+			name:    "multi_line",
+			content: "CERT=\"-----BEGIN-----\nabc\n-----END-----\"\nKEY='line1\nline2'\n",
+			want:    []EnvVar{{"CERT", "-----BEGIN-----\nabc\n-----END-----"}, {"KEY", "line1\nline2"}},
+		},
+		{
+			name:    "duplicate_key_last_wins",
+			content: "A=1\nB=2\nA=3\n",
+			want:    []EnvVar{{"A", "3"}, {"B", "2"}},
+		},
+		{name: "missing_equals", content: "A=1\nsecret-value\n", wantErr: "line 2: expected KEY=VALUE"},
+		{name: "invalid_key", content: "1A=x\n", wantErr: "line 1"},
+		{name: "unterminated", content: "A=\"secret\nB=2\n", wantErr: "unterminated quoted value for A"},
+		{name: "trailing_garbage", content: "A='x' secret\n", wantErr: "unexpected characters"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEnv(tt.content)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseEnv() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				if strings.Contains(err.Error(), "secret") {
+					t.Errorf("parseEnv() error leaks the value: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseEnv() returned unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseEnv() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderEnvRoundTrip(t *testing.T) {
+	vars := []EnvVar{
+		{"DOCKER_TAG", "abc1234"},
+		{"URL", "postgres://u:p@db/app?sslmode=disable"},
+		{"SPACES", "hello world"},
+		{"HASH", "#not-a-comment"},
+		{"DOLLAR", "pa$$word"},
+		{"QUOTES", `it's "quoted" \ $HOME`},
+		{"MULTI", "line1\nline2"},
+		{"EMPTY", ""},
+	}
+
+	rendered := string(renderEnv(vars))
+	for _, want := range []string{"DOCKER_TAG=abc1234\n", "SPACES='hello world'\n", "DOLLAR='pa$$word'\n", `MULTI="line1\nline2"` + "\n"} {
+		if !strings.Contains(rendered, want) {
+			t.Errorf("renderEnv() = %q, want it to contain %q", rendered, want)
+		}
+	}
+
+	parsed, err := parseEnv(rendered)
+	if err != nil {
+		t.Fatalf("parseEnv() returned unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, vars) {
+		t.Errorf("round trip = %q, want %q", parsed, vars)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	workspace := t.TempDir()
+	t.Setenv("GITHUB_WORKSPACE", workspace)
+	if err := os.WriteFile(filepath.Join(workspace, "prod.env"), []byte("LOG_LEVEL=info\nDB_HOST=db\nDOCKER_TAG=latest\n"), 0600); err != nil {
+		t.Fatalf("failed to write env file: %v", err)
+	}
+
+	// env overrides env_file, DOCKER_TAG is reserved for docker_tag
+	got, err := loadEnv("prod.env", "LOG_LEVEL=debug\nFEATURE=on\n")
+	if err != nil {
+		t.Fatalf("loadEnv() returned unexpected error: %v", err)
+	}
+	want := []EnvVar{{"LOG_LEVEL", "debug"}, {"DB_HOST", "db"}, {"FEATURE", "on"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadEnv() = %q, want %q", got, want)
+	}
+
+	if _, err := loadEnv("missing.env", ""); err == nil {
+		t.Error("loadEnv() should fail for a missing env_file")
+	}
+}
+
+func TestMaskEnv(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	maskEnv([]EnvVar{{"PASSWORD", "hunter2"}, {"CERT", "line1\nline2"}, {"EMPTY", ""}})
+	os.Stdout = stdout
+	w.Close()
+
+	out := new(strings.Builder)
+	if _, err := io.Copy(out, r); err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	want := "::add-mask::hunter2\n::add-mask::line1\n::add-mask::line2\n"
+	if out.String() != want {
+		t.Errorf("maskEnv() output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestEnvDiff(t *testing.T) {
+	existing := []EnvVar{{"DOCKER_TAG", "old"}, {"DB_PASSWORD", "s3cret"}, {"LOG_LEVEL", "info"}}
+	managed := []EnvVar{{"DOCKER_TAG", "new"}, {"LOG_LEVEL", "info"}, {"FEATURE", "on"}}
+
+	want := []string{
+		"~ DOCKER_TAG (changed)",
+		"= LOG_LEVEL (unchanged)",
+		"+ FEATURE (added)",
+		"  DB_PASSWORD (kept)",
+	}
+	got := envDiff(existing, managed)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("envDiff() = %q, want %q", got, want)
+	}
+	for _, line := range got {
+		if strings.Contains(line, "s3cret") || strings.Contains(line, "new") {
+			t.Errorf("envDiff() leaks a value: %q", line)
+		}
+	}
+}
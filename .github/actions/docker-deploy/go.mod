@@ -4,6 +4,12 @@ go 1.23.0
 
 toolchain go1.23.6
 
-require golang.org/x/crypto v0.36.0
-
-require golang.org/x/sys v0.31.0 // indirect
+require (
+	github.com/pkg/sftp v1.13.9
+	golang.org/x/crypto v0.36.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+)
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// healthLogLines is how many log lines are printed per failing service
+const healthLogLines = 20
+
+// healthPollInterval is the delay between two container state checks
+var healthPollInterval = 2 * time.Second
+
+// inspectFormat prints one line per container: service, status, health
+// ("none" without a healthcheck), restart count and exit code
+const inspectFormat = `{{index .Config.Labels "com.docker.compose.service"}} {{.State.Status}} ` +
+	`{{if .State.Health}}{{.State.Health.Status}}{{else}}none{{end}} {{.RestartCount}} {{.State.ExitCode}}`
+
+// containerState is the state of one container of the stack
+type containerState struct {
+	Service  string
+	Status   string
+	Health   string
+	Restarts int
+	ExitCode int
+}
+
+// ready reports whether the container is running and, if it has a
+// healthcheck, healthy. One-off containers that exited with 0 count as ready.
+func (c containerState) ready() bool {
+	if c.Status == "exited" {
+		return c.ExitCode == 0
+	}
+	return c.Status == "running" && (c.Health == "none" || c.Health == "healthy")
+}
+
+// failed reports whether the container stopped and won't come back by itself
+func (c containerState) failed() bool {
+	return c.Status == "dead" || (c.Status == "exited" && c.ExitCode != 0)
+}
+
+func (c containerState) String() string {
+	s := c.Status
+	if c.Status == "exited" {
+		s = fmt.Sprintf("exited (%d)", c.ExitCode)
+	}
+	if c.Health != "none" {
+		s += ", " + c.Health
+	}
+	return fmt.Sprintf("%s, %d restarts", s, c.Restarts)
+}
+
+// parseContainerStates parses the output of docker inspect with inspectFormat
+func parseContainerStates(output string) ([]containerState, error) {
+	var states []containerState
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("unexpected container state %q", line)
+		}
+		restarts, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected restart count in %q", line)
+		}
+		exitCode, err := strconv.Atoi(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected exit code in %q", line)
+		}
+		states = append(states, containerState{
+			Service:  fields[0],
+			Status:   fields[1],
+			Health:   fields[2],
+			Restarts: restarts,
+			ExitCode: exitCode,
+		})
+	}
+	return states, nil
+}
+
+// containerStates returns the state of every container of the given services
+func (d *Deployment) containerStates(ctx context.Context, services []string) ([]containerState, error) {
+	ps := d.composeCommand(append([]string{"ps", "-a", "-q"}, quoteAll(services)...)...)
+	cmd := fmt.Sprintf(`ids=$(%s) && if [ -n "$ids" ]; then docker inspect --format %s $ids; fi`, ps, shellQuote(inspectFormat))
+	result, err := d.Client.RunCommand(ctx, cmd)
+	if err != nil {
+		return nil, commandError("docker inspect", result, err)
+	}
+	return parseContainerStates(result.Stdout)
+}
+
+// waitHealthy polls the containers of the deployed services until all are
+// ready in two consecutive checks without restarting in between, or until
+// timeout. On failure the state and last log lines of every failing service
+// are printed.
+func (d *Deployment) waitHealthy(ctx context.Context, services []string, timeout time.Duration) error {
+	log(fmt.Sprintf("Waiting up to %s for services to become healthy: %s", timeout, strings.Join(services, ", ")))
+	deadline := time.Now().Add(timeout)
+
+	var previous map[string]string
+	var lastStatus string
+	for {
+		states, err := d.containerStates(ctx, services)
+		if err != nil {
+			return err
+		}
+		current, pending, failed := serviceStatus(services, states)
+
+		switch {
+		case len(failed) > 0:
+			d.reportUnhealthy(ctx, current, failed)
+			return fmt.Errorf("services failed to start: %s", strings.Join(failed, ", "))
+		case len(pending) == 0 && equalStatus(previous, current):
+			log(fmt.Sprintf("All services are healthy: %s", strings.Join(services, ", ")))
+			return nil
+		}
+
+		if status := formatStatus(services, current); status != lastStatus {
+			log(fmt.Sprintf("Service status:\n  %s", status))
+			lastStatus = status
+		}
+		previous = current
+
+		if time.Now().After(deadline) {
+			if len(pending) == 0 {
+				// Ready, but restarted between the last two checks
+				pending = services
+			}
+			d.reportUnhealthy(ctx, current, pending)
+			return fmt.Errorf("services not healthy after %s: %s", timeout, strings.Join(pending, ", "))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(healthPollInterval):
+		}
+	}
+}
+
+// serviceStatus describes every service and lists those still starting and
+// those that failed
+func serviceStatus(services []string, states []containerState) (current map[string]string, pending, failed []string) {
+	byService := map[string][]containerState{}
+	for _, s := range states {
+		byService[s.Service] = append(byService[s.Service], s)
+	}
+
+	current = map[string]string{}
+	for _, service := range services {
+		containers := byService[service]
+		if len(containers) == 0 {
+			current[service] = "no container"
+			pending = append(pending, service)
+			continue
+		}
+
+		var descriptions []string
+		ready, hasFailed := true, false
+		for _, c := range containers {
+			descriptions = append(descriptions, c.String())
+			ready = ready && c.ready()
+			hasFailed = hasFailed || c.failed()
+		}
+		sort.Strings(descriptions)
+		current[service] = strings.Join(descriptions, "; ")
+
+		switch {
+		case hasFailed:
+			failed = append(failed, service)
+		case !ready:
+			pending = append(pending, service)
+		}
+	}
+	return current, pending, failed
+}
+
+// equalStatus reports whether two polls saw the same state, restart counts
+// included
+func equalStatus(a, b map[string]string) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// formatStatus lists the status of every service in order
+func formatStatus(services []string, current map[string]string) string {
+	lines := make([]string, len(services))
+	for i, service := range services {
+		lines[i] = fmt.Sprintf("%s: %s", service, current[service])
+	}
+	return strings.Join(lines, "\n  ")
+}
+
+// reportUnhealthy prints the state and last log lines of the given services
+func (d *Deployment) reportUnhealthy(ctx context.Context, current map[string]string, services []string) {
+	for _, service := range services {
+		msg := fmt.Sprintf("Service %s is not healthy: %s", service, current[service])
+		result, err := d.Client.RunCommand(ctx, d.composeCommand("logs", "--no-color", "--tail", strconv.Itoa(healthLogLines), shellQuote(service)))
+		if err != nil {
+			msg += fmt.Sprintf("\nFailed to read its logs: %v", err)
+		} else if output := strings.TrimSpace(result.Output()); output != "" {
+			msg += fmt.Sprintf("\nLast log lines:\n  %s", strings.Join(strings.Split(output, "\n"), "\n  "))
+		}
+		logError(msg)
+	}
+}
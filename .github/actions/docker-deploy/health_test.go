@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseContainerStates(t *testing.T) {
+	states, err := parseContainerStates("api running healthy 0 0\nworker restarting none 4 1\n")
+	if err != nil {
+		t.Fatalf("parseContainerStates() returned unexpected error: %v", err)
+	}
+	want := []containerState{
+		{Service: "api", Status: "running", Health: "healthy"},
+		{Service: "worker", Status: "restarting", Health: "none", Restarts: 4, ExitCode: 1},
+	}
+	if len(states) != len(want) {
+		t.Fatalf("parseContainerStates() = %+v, want %+v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Errorf("state %d = %+v, want %+v", i, states[i], want[i])
+		}
+	}
+
+	if _, err := parseContainerStates("api running\n"); err == nil {
+		t.Error("parseContainerStates() should reject incomplete lines")
+	}
+}
+
+func TestServiceStatus(t *testing.T) {
+	states := []containerState{
+		{Service: "api", Status: "running", Health: "healthy"},
+		{Service: "migrate", Status: "exited", Health: "none"},
+		{Service: "web", Status: "running", Health: "starting"},
+		{Service: "worker", Status: "exited", Health: "none", Restarts: 2, ExitCode: 137},
+	}
+	current, pending, failed := serviceStatus([]string{"api", "migrate", "web", "worker", "redis"}, states)
+	if strings.Join(pending, ",") != "web,redis" {
+		t.Errorf("pending = %q, want web and redis", pending)
+	}
+	if strings.Join(failed, ",") != "worker" {
+		t.Errorf("failed = %q, want worker", failed)
+	}
+	if current["worker"] != "exited (137), 2 restarts" || current["redis"] != "no container" {
+		t.Errorf("current = %q", current)
+	}
+}
+
+func TestWaitHealthy(t *testing.T) {
+	healthPollInterval = time.Millisecond
+	t.Cleanup(func() { healthPollInterval = 2 * time.Second })
+
+	tests := []struct {
+		name    string
+		state   func(poll int) string
+		timeout time.Duration
+		wantErr string
+	}{
+		{
+			name: "becomes_healthy",
+			state: func(poll int) string {
+				if poll == 0 {
+					return "api running starting 0 0"
+				}
+				return "api running healthy 0 0"
+			},
+		},
+		{
+			name: "crash_loop",
+			// Running at every check, but restarted in between
+			state:   func(poll int) string { return fmt.Sprintf("api running none %d 0", poll) },
+			timeout: 20 * time.Millisecond,
+			wantErr: "services not healthy after 20ms: api",
+		},
+		{
+			name:    "exited",
+			state:   func(int) string { return "api exited none 0 1" },
+			wantErr: "services failed to start: api",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var polls, logs int
+			client := &SSHClient{
+				RunCommand: func(ctx context.Context, cmd string) (*CommandResult, error) {
+					if strings.Contains(cmd, " logs ") {
+						logs++
+						return &CommandResult{Stdout: "api  | panic: boom\n"}, nil
+					}
+					state := tt.state(polls)
+					polls++
+					return &CommandResult{Stdout: state + "\n"}, nil
+				},
+			}
+			d := &Deployment{Inputs: &Inputs{RemoteDir: "."}, Client: client, composeFiles: []string{"docker-compose.yml"}}
+
+			timeout := tt.timeout
+			if timeout == 0 {
+				timeout = time.Minute
+			}
+			err := d.waitHealthy(context.Background(), []string{"api"}, timeout)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("waitHealthy() returned unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("waitHealthy() error = %v, want %q", err, tt.wantErr)
+			}
+			if logs != 1 {
+				t.Errorf("logs of the failing service read %d times, want 1", logs)
+			}
+		})
+	}
+}
+
+func TestReportUnhealthy(t *testing.T) {
+	client := &SSHClient{
+		RunCommand: func(ctx context.Context, cmd string) (*CommandResult, error) {
+			return &CommandResult{Stdout: "api  | starting\n::add-mask::hunter2\n"}, nil
+		},
+	}
+	d := &Deployment{Inputs: &Inputs{RemoteDir: "."}, Client: client, composeFiles: []string{"docker-compose.yml"}}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	d.reportUnhealthy(context.Background(), map[string]string{"api": "exited (1)"}, []string{"api"})
+	os.Stdout = stdout
+	w.Close()
+
+	out := new(strings.Builder)
+	if _, err := io.Copy(out, r); err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	// Container output cannot issue workflow commands
+	want := regexp.MustCompile(`^::error::Service api is not healthy: exited \(1\)\n::stop-commands::(\w+)\nLast log lines:\n  api  \| starting\n  ::add-mask::hunter2\n::(\w+)::\n$`)
+	m := want.FindStringSubmatch(out.String())
+	if m == nil || m[1] != m[2] {
+		t.Errorf("reportUnhealthy() output = %q", out.String())
+	}
+}
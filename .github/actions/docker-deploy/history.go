@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// historyFile is the JSON-lines ledger of all deployments, relative to
+	// the remote directory
+	historyFile = "deployments.jsonl"
+	// historyTimeout bounds writing the ledger entry, which also happens
+	// after the deploy timed out or was cancelled
+	historyTimeout = 30 * time.Second
+)
+
+// Deployment results recorded in the ledger
+const (
+	ResultSuccess    = "success"
+	ResultFailed     = "failed"
+	ResultRolledBack = "rolled_back"
+)
+
+// historyEntry is one line of the ledger
+type historyEntry struct {
+	Mode          string    `json:"mode"`
+	Tag           string    `json:"tag"`
+	Release       string    `json:"release,omitempty"`
+	ComposeSHA256 string    `json:"compose_sha256,omitempty"`
+	RunID         string    `json:"run_id,omitempty"`
+	Actor         string    `json:"actor,omitempty"`
+	Ref           string    `json:"ref,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	Result        string    `json:"result"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// recordHistory appends the outcome of the run that started at started and
+// ended with err to the ledger. Failing to write it only logs a warning.
+func (d *Deployment) recordHistory(ctx context.Context, started time.Time, err error) {
+	entry := historyEntry{
+		Mode:          d.Inputs.Mode,
+		Tag:           d.tag,
+		Release:       d.release.ID,
+		ComposeSHA256: d.composeSHA256,
+		RunID:         d.Inputs.RunID,
+		Actor:         d.Inputs.Actor,
+		Ref:           d.Inputs.Ref,
+		StartedAt:     started.UTC().Truncate(time.Second),
+		FinishedAt:    time.Now().UTC().Truncate(time.Second),
+		Result:        ResultSuccess,
+	}
+	if err != nil {
+		entry.Result = ResultFailed
+		if d.rolledBack {
+			entry.Result = ResultRolledBack
+		}
+		entry.Error = err.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logWarning(fmt.Sprintf("Failed to encode the history entry: %v", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), historyTimeout)
+	defer cancel()
+	cmd := d.inRemoteDir(fmt.Sprintf("printf '%%s\\n' %s >> %s", shellQuote(string(line)), historyFile))
+	if result, err := d.Client.RunCommand(ctx, cmd); err != nil {
+		logWarning(fmt.Sprintf("Failed to record the deployment in %s: %v", historyFile, commandError("append", result, err)))
+		return
+	}
+	log(fmt.Sprintf("Recorded the deployment in %s", d.remotePath(historyFile)))
+}
+
+// readHistory returns the ledger entries, oldest first. Lines that cannot be
+// parsed are skipped with a warning.
+func (d *Deployment) readHistory(ctx context.Context) ([]historyEntry, error) {
+	cmd := d.inRemoteDir(fmt.Sprintf("if [ -e %[1]s ]; then cat %[1]s; fi", historyFile))
+	result, err := d.Client.RunCommand(ctx, cmd)
+	if err != nil {
+		return nil, commandError("cat "+historyFile, result, err)
+	}
+
+	var entries []historyEntry
+	for i, line := range strings.Split(result.Stdout, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var entry historyEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			logWarning(fmt.Sprintf("Skipping line %d of %s: %v", i+1, historyFile, err))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// History prints the newest limit ledger entries (all if limit is 0) as a
+// table and as JSON, and sets the history output
+func (d *Deployment) History(ctx context.Context, limit int) error {
+	entries, err := d.readHistory(ctx)
+	if err != nil {
+		return err
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	if len(entries) == 0 {
+		log(fmt.Sprintf("No deployments recorded in %s", d.remotePath(historyFile)))
+		return setOutput("history", "[]")
+	}
+
+	log(fmt.Sprintf("Deployment history (%d entries):\n%s", len(entries), formatHistory(entries)))
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode history: %v", err)
+	}
+	fmt.Println(string(data))
+
+	compact, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode history: %v", err)
+	}
+	return setOutput("history", string(compact))
+}
+
+// formatHistory renders the entries as an aligned table, newest first
+func formatHistory(entries []historyEntry) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tDURATION\tMODE\tTAG\tRESULT\tRUN\tACTOR\tREF")
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.StartedAt.UTC().Format("2006-01-02 15:04:05"), e.FinishedAt.Sub(e.StartedAt),
+			e.Mode, orDash(e.Tag), e.Result, orDash(e.RunID), orDash(e.Actor), orDash(e.Ref))
+	}
+	w.Flush()
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// orDash renders empty table cells as "-"
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeploymentHistory(t *testing.T) {
+	server, client := newTestClient(t)
+	outputFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", outputFile)
+
+	if err := os.Mkdir(filepath.Join(server.Dir, "stack"), 0755); err != nil {
+		t.Fatalf("failed to create remote directory: %v", err)
+	}
+	d := &Deployment{
+		Inputs: &Inputs{Mode: ModeDeploy, RemoteDir: "stack", RunID: "42", Actor: "octocat", Ref: "refs/heads/main"},
+		Client: client,
+	}
+
+	// A missing ledger is an empty history
+	if err := d.History(context.Background(), 0); err != nil {
+		t.Fatalf("History() returned unexpected error: %v", err)
+	}
+
+	started := time.Now().Add(-time.Minute)
+	d.tag, d.composeSHA256 = "v1", strings.Repeat("a", 64)
+	d.recordHistory(context.Background(), started, nil)
+	d.tag, d.rolledBack = "v2", true
+	d.recordHistory(context.Background(), started, errors.New("docker compose up: exit code 1"))
+
+	// Unparseable lines are skipped
+	ledger := filepath.Join(server.Dir, "stack", historyFile)
+	f, err := os.OpenFile(ledger, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open ledger: %v", err)
+	}
+	f.WriteString("{truncated\n")
+	f.Close()
+
+	entries, err := d.readHistory(context.Background())
+	if err != nil {
+		t.Fatalf("readHistory() returned unexpected error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("readHistory() returned %d entries, want 2", len(entries))
+	}
+	first, second := entries[0], entries[1]
+	if first.Tag != "v1" || first.Result != ResultSuccess || first.ComposeSHA256 != d.composeSHA256 ||
+		first.RunID != "42" || first.Actor != "octocat" || first.Ref != "refs/heads/main" {
+		t.Errorf("first entry = %+v", first)
+	}
+	if second.Tag != "v2" || second.Result != ResultRolledBack || !strings.Contains(second.Error, "exit code 1") {
+		t.Errorf("second entry = %+v", second)
+	}
+	if d := second.FinishedAt.Sub(second.StartedAt); d < time.Minute || d > 2*time.Minute {
+		t.Errorf("second entry took %s, want about a minute", d)
+	}
+
+	// The history output holds the newest entries as JSON
+	os.Remove(outputFile)
+	if err := d.History(context.Background(), 1); err != nil {
+		t.Fatalf("History() returned unexpected error: %v", err)
+	}
+	output, _ := os.ReadFile(outputFile)
+	value, ok := strings.CutPrefix(strings.TrimSpace(string(output)), "history=")
+	if !ok {
+		t.Fatalf("history output missing: %q", output)
+	}
+	var got []historyEntry
+	if err := json.Unmarshal([]byte(value), &got); err != nil || len(got) != 1 || got[0].Tag != "v2" {
+		t.Errorf("history output = %s (%v), want the v2 entry", value, err)
+	}
+}
+
+func TestFormatHistory(t *testing.T) {
+	started := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	table := formatHistory([]historyEntry{
+		{Mode: ModeDeploy, Tag: "v1", StartedAt: started, FinishedAt: started.Add(90 * time.Second), Result: ResultSuccess, RunID: "41"},
+		{Mode: ModeRollback, Tag: "v0", StartedAt: started.Add(time.Hour), FinishedAt: started.Add(time.Hour + 5*time.Second), Result: ResultFailed},
+	})
+	lines := strings.Split(table, "\n")
+	if len(lines) != 3 {
+		t.Fatalf("formatHistory() = %q, want a header and 2 rows", table)
+	}
+	if !strings.HasPrefix(lines[0], "STARTED") || !strings.Contains(lines[1], "13:00:00") || !strings.Contains(lines[2], "1m30s") {
+		t.Errorf("formatHistory() should list the newest entry first:\n%s", table)
+	}
+	if fields := strings.Fields(lines[1]); fields[len(fields)-1] != "-" {
+		t.Errorf("empty cells should be rendered as -: %q", lines[1])
+	}
+}
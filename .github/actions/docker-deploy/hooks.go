@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Hook is a remote command run before or after docker compose up. A failing
+// hook fails the deploy unless ContinueOnError is set.
+type Hook struct {
+	Command         string
+	ContinueOnError bool
+}
+
+// parseHooks parses the pre_deploy and post_deploy inputs, one command per
+// line. As in make, a leading - lets the deploy continue when the command
+// fails.
+func parseHooks(value string) []Hook {
+	var hooks []Hook
+	for _, line := range parseList(value) {
+		hook := Hook{Command: line}
+		if rest, ok := strings.CutPrefix(line, "-"); ok {
+			hook = Hook{Command: strings.TrimSpace(rest), ContinueOnError: true}
+		}
+		if hook.Command != "" {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// hookCommand runs cmd in the release being deployed with the variables of
+// its .env exported, and COMPOSE_* set so that plain docker compose commands
+// use the project, files and profiles of the deploy. The variables come from
+// memory rather than sourcing .env, whose syntax the shell does not share.
+func (d *Deployment) hookCommand(cmd string) string {
+	var exports strings.Builder
+	for _, v := range d.env {
+		fmt.Fprintf(&exports, "export %s=%s && ", v.Key, shellQuote(v.Value))
+	}
+	return d.inComposeDir(fmt.Sprintf("%sCOMPOSE_PROJECT_NAME=%s COMPOSE_FILE=%s COMPOSE_PROFILES=%s exec sh -c %s", exports.String(),
+		d.projectWord(), shellQuote(strings.Join(d.composeFiles, ":")), shellQuote(strings.Join(d.Inputs.Profiles, ",")), shellQuote(cmd)))
+}
+
+// runHooks runs the hooks of stage in order, streaming their output. Each
+// is bounded by command_timeout like every remote command.
+func (d *Deployment) runHooks(ctx context.Context, stage string, hooks []Hook) error {
+	for i, hook := range hooks {
+		log(fmt.Sprintf("Running %s hook %d/%d: %s", stage, i+1, len(hooks), hook.Command))
+		result, err := d.Client.StreamCommand(ctx, d.hookCommand(hook.Command))
+		if err == nil {
+			continue
+		}
+		err = commandError(fmt.Sprintf("%s hook %q", stage, hook.Command), result, err)
+		if !hook.ContinueOnError || ctx.Err() != nil {
+			return err
+		}
+		logWarning(fmt.Sprintf("Continuing despite the failed hook: %v", err))
+	}
+	if len(hooks) > 0 {
+		log(fmt.Sprintf("Finished %d %s hooks", len(hooks), stage))
+	}
+	return nil
+}
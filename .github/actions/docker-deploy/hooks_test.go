@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseHooks(t *testing.T) {
+	hooks := parseHooks("docker compose run --rm api php artisan migrate\n# comment\n- curl -fsS http://localhost/warm\n-\n")
+	want := []Hook{
+		{Command: "docker compose run --rm api php artisan migrate"},
+		{Command: "curl -fsS http://localhost/warm", ContinueOnError: true},
+	}
+	if len(hooks) != len(want) {
+		t.Fatalf("parseHooks() = %+v, want %+v", hooks, want)
+	}
+	for i := range want {
+		if hooks[i] != want[i] {
+			t.Errorf("hook %d = %+v, want %+v", i, hooks[i], want[i])
+		}
+	}
+}
+
+func TestDeploymentHooks(t *testing.T) {
+	server, client := newTestClient(t)
+	client.logOutput = io.Discard
+	dockerLog := fakeDocker(t, "")
+	t.Setenv("GITHUB_OUTPUT", "")
+
+	local := t.TempDir()
+	writeTestFiles(t, local, map[string]os.FileMode{"docker-compose.yml": 0644, "prod/override.yml": 0644})
+	tricky := "it's `touch pwned` $HOME\n\\n \"quoted\""
+	logLine := `echo "$PWD hook $1 $GREETING $COMPOSE_PROJECT_NAME $COMPOSE_FILE $COMPOSE_PROFILES" >> "$DOCKER_LOG"`
+	d := &Deployment{
+		Inputs: &Inputs{
+			ComposeFiles: []string{filepath.Join(local, "docker-compose.yml"), filepath.Join(local, "prod", "override.yml")},
+			Profiles:     []string{"workers"},
+			DockerTag:    "abc1234",
+			RemoteDir:    "stack",
+			Env:          []EnvVar{{Key: "GREETING", Value: "hello world"}, {Key: "TRICKY", Value: tricky}},
+			PreDeploy:    parseHooks(strings.ReplaceAll(logLine, "$1", "migrate") + "\n" + `printf %s "$TRICKY" > "$DOCKER_LOG.tricky"`),
+			PostDeploy:   parseHooks("-exit 3\n" + strings.ReplaceAll(logLine, "$1", "warm")),
+			KeepReleases: 10,
+		},
+		Client: client,
+	}
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+
+	// Hooks run in the release directory with the .env variables and compose settings
+	// of the deploy, pre_deploy between pull and up
+	releaseDir, err := filepath.EvalSymlinks(filepath.Join(server.Dir, "stack", "current"))
+	if err != nil {
+		t.Fatalf("current does not resolve: %v", err)
+	}
+	data, err := os.ReadFile(dockerLog)
+	if err != nil {
+		t.Fatalf("nothing was run: %v", err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		got = append(got, strings.TrimPrefix(line, releaseDir+" "))
+	}
+	compose := "compose -p stack -f docker-compose.yml -f prod/override.yml --profile workers"
+	want := []string{
+		compose + " config --services",
+		compose + " pull",
+		"hook migrate hello world stack docker-compose.yml:prod/override.yml workers",
+		compose + " up -d",
+		"hook warm hello world stack docker-compose.yml:prod/override.yml workers",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+	// Values arrive as they are, without running commands or unescaping
+	if data, _ := os.ReadFile(dockerLog + ".tricky"); string(data) != tricky {
+		t.Errorf("TRICKY = %q, want %q", data, tricky)
+	}
+	if _, err := os.Stat(filepath.Join(releaseDir, "pwned")); !os.IsNotExist(err) {
+		t.Errorf("a command in a value ran: %v", err)
+	}
+
+	// A failing pre_deploy hook fails the deploy before current is switched
+	d.Inputs.DockerTag = "def5678"
+	d.Inputs.AutoRollback = true
+	d.Inputs.PreDeploy = parseHooks("echo migration failed >&2; exit 2")
+	err = d.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), `pre_deploy hook "echo migration failed >&2; exit 2"`) ||
+		!strings.Contains(err.Error(), "migration failed") || strings.Contains(err.Error(), "Rolled back") {
+		t.Errorf("Run() error = %v, want hook failure without rollback", err)
+	}
+	if got := releaseTags(t, d); got != "abc1234" {
+		t.Errorf("release tags = %q, want abc1234", got)
+	}
+
+	// A failing post_deploy hook rolls back
+	d.Inputs.PreDeploy = nil
+	d.Inputs.PostDeploy = parseHooks("exit 4")
+	if err := d.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "Rolled back to abc1234") {
+		t.Errorf("Run() error = %v, want hook failure and rollback", err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyVerifier checks the key offered by a server against known_hosts
+// entries, pinned SHA256 fingerprints and/or trusted host certificate authorities
+type HostKeyVerifier struct {
+	knownHosts   ssh.HostKeyCallback
+	fingerprints []string
+	authorities  []ssh.PublicKey
+	// knownHostsCA is set when known_hosts contains @cert-authority lines
+	knownHostsCA bool
+}
+
+// NewHostKeyVerifier builds a verifier from known_hosts content (or a path to
+// a known_hosts file), a list of pinned fingerprints and host CA public keys.
+// At least one of them must be provided.
+func NewHostKeyVerifier(knownHosts, fingerprints, hostCA string) (*HostKeyVerifier, error) {
+	v := &HostKeyVerifier{fingerprints: parseFingerprints(fingerprints)}
+
+	if strings.TrimSpace(knownHosts) != "" {
+		cb, hasCA, err := loadKnownHosts(knownHosts)
+		if err != nil {
+			return nil, err
+		}
+		v.knownHosts = cb
+		v.knownHostsCA = hasCA
+	}
+
+	authorities, err := ParseCertAuthorities(hostCA)
+	if err != nil {
+		return nil, err
+	}
+	v.authorities = authorities
+
+	if v.knownHosts == nil && len(v.fingerprints) == 0 && len(v.authorities) == 0 {
+		return nil, fmt.Errorf("host key verification requires known_hosts, host_fingerprint or host_ca")
+	}
+
+	return v, nil
+}
+
+// Callback returns an ssh.HostKeyCallback performing the verification
+func (v *HostKeyVerifier) Callback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if cert, ok := key.(*ssh.Certificate); ok {
+			if err := v.checkCertificate(hostname, remote, cert); err != nil {
+				return hostKeyError(hostname, key, err)
+			}
+			// Pins refer to the certified key itself
+			key = cert.Key
+		} else if v.knownHosts != nil {
+			if err := v.knownHosts(hostname, remote, key); err != nil {
+				return hostKeyError(hostname, key, err)
+			}
+		} else if len(v.fingerprints) == 0 {
+			return hostKeyError(hostname, key, fmt.Errorf("server did not present a host certificate"))
+		}
+
+		if len(v.fingerprints) > 0 && !v.matchesFingerprint(key) {
+			return hostKeyError(hostname, key, fmt.Errorf("fingerprint does not match any pinned host_fingerprint"))
+		}
+		return nil
+	}
+}
+
+// checkCertificate verifies a host certificate against host_ca or the
+// @cert-authority entries in known_hosts
+func (v *HostKeyVerifier) checkCertificate(hostname string, remote net.Addr, cert *ssh.Certificate) error {
+	host, _, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host = hostname
+	}
+	if err := checkCertificate(cert, ssh.HostCert, host, time.Now()); err != nil {
+		return err
+	}
+
+	if v.isAuthority(cert.SignatureKey) {
+		checker := &ssh.CertChecker{
+			IsHostAuthority: func(ssh.PublicKey, string) bool { return true },
+		}
+		return checker.CheckHostKey(hostname, remote, cert)
+	}
+	if v.knownHosts != nil {
+		return v.knownHosts(hostname, remote, cert)
+	}
+	return fmt.Errorf("certificate is signed by an untrusted authority")
+}
+
+func (v *HostKeyVerifier) isAuthority(key ssh.PublicKey) bool {
+	for _, ca := range v.authorities {
+		if bytes.Equal(ca.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostKeyAlgorithms returns the key algorithms known for the given host so the
+// server is asked for a key we can actually verify. Certificate algorithms
+// come first when a host CA is trusted. Without one, only plain keys are
+// asked for, as a certificate could not be verified even when the certified
+// key is pinned.
+func (v *HostKeyVerifier) HostKeyAlgorithms(hostport string) []string {
+	known := v.knownAlgorithms(hostport)
+	if len(v.authorities) > 0 || v.knownHostsCA {
+		return append(append([]string(nil), certAlgorithms...), known...)
+	}
+	if len(known) == 0 {
+		return plainAlgorithms
+	}
+	return known
+}
+
+// knownAlgorithms returns the algorithms of the plain keys recorded in
+// known_hosts for the host
+func (v *HostKeyVerifier) knownAlgorithms(hostport string) []string {
+	if v.knownHosts == nil {
+		return nil
+	}
+
+	// Probe known_hosts with a throwaway key; the resulting KeyError lists
+	// the keys recorded for the host.
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if err := v.knownHosts(hostport, &net.TCPAddr{}, probe); !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var algos []string
+	seen := map[string]bool{}
+	for _, known := range keyErr.Want {
+		for _, algo := range algorithmsForKeyType(known.Key.Type()) {
+			if !seen[algo] {
+				seen[algo] = true
+				algos = append(algos, algo)
+			}
+		}
+	}
+	return algos
+}
+
+func (v *HostKeyVerifier) matchesFingerprint(key ssh.PublicKey) bool {
+	got := normalizeFingerprint(ssh.FingerprintSHA256(key))
+	for _, want := range v.fingerprints {
+		if got == want {
+			return true
+		}
+	}
+	return false
+}
+
+// algorithmsForKeyType maps a public key type to the host key algorithms
+// that can be negotiated for it
+func algorithmsForKeyType(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// hostKeyError describes a rejected host key, including the type and
+// fingerprint the server offered so it can be compared with ssh-keyscan output
+func hostKeyError(hostname string, key ssh.PublicKey, err error) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return fmt.Errorf("host key verification failed for %s: server offered %s certificate for key %s signed by CA %s: %v",
+			hostname, cert.Type(), ssh.FingerprintSHA256(cert.Key), ssh.FingerprintSHA256(cert.SignatureKey), err)
+	}
+
+	reason := err.Error()
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		if len(keyErr.Want) == 0 {
+			reason = "host is not listed in known_hosts"
+		} else {
+			reason = "key does not match the one recorded in known_hosts (possible man-in-the-middle attack)"
+		}
+	}
+	var revokedErr *knownhosts.RevokedError
+	if errors.As(err, &revokedErr) {
+		reason = "key is marked as revoked in known_hosts"
+	}
+
+	return fmt.Errorf("host key verification failed for %s: server offered %s key %s: %s",
+		hostname, key.Type(), ssh.FingerprintSHA256(key), reason)
+}
+
+// loadKnownHosts parses known_hosts given either as file content or as a path
+// (absolute or relative to the workspace). It also reports whether any
+// @cert-authority entries are present.
+func loadKnownHosts(value string) (ssh.HostKeyCallback, bool, error) {
+	value = strings.TrimSpace(value)
+	if !strings.ContainsAny(value, " \t\n") {
+		path := resolveWorkspacePath(value)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to load known_hosts file %s: %v", path, err)
+		}
+		cb, err := knownhosts.New(path)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to load known_hosts file %s: %v", path, err)
+		}
+		return cb, hasCertAuthority(string(content)), nil
+	}
+
+	// knownhosts only reads from files, so stage the content in a private
+	// temporary directory. Host keys are public, nothing sensitive is written.
+	dir, err := os.MkdirTemp("", "known-hosts-")
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create known_hosts directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(path, []byte(value+"\n"), 0600); err != nil {
+		return nil, false, fmt.Errorf("failed to write known_hosts: %v", err)
+	}
+
+	cb, err := knownhosts.New(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse known_hosts: %v", err)
+	}
+	return cb, hasCertAuthority(value), nil
+}
+
+func hasCertAuthority(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "@cert-authority") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFingerprints splits a comma or whitespace separated list of SHA256
+// fingerprints
+func parseFingerprints(value string) []string {
+	var fingerprints []string
+	for _, f := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}) {
+		fingerprints = append(fingerprints, normalizeFingerprint(f))
+	}
+	return fingerprints
+}
+
+// normalizeFingerprint accepts fingerprints with or without the "SHA256:"
+// prefix and base64 padding
+func normalizeFingerprint(f string) string {
+	f = strings.TrimPrefix(strings.TrimSpace(f), "SHA256:")
+	return strings.TrimRight(f, "=")
+}
+
+// resolveWorkspacePath resolves relative paths against GITHUB_WORKSPACE
+func resolveWorkspacePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if workspace := os.Getenv("GITHUB_WORKSPACE"); workspace != "" {
+		return filepath.Join(workspace, filepath.Clean(path))
+	}
+	return path
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestHostKey(t testing.TB) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("failed to convert key: %v", err)
+	}
+	return key
+}
+
+func TestHostKeyVerifierRequiresConfiguration(t *testing.T) {
+	if _, err := NewHostKeyVerifier("", "", ""); err == nil {
+		t.Error("NewHostKeyVerifier() without known_hosts or fingerprint should return error")
+	}
+}
+
+func TestHostKeyVerifierKnownHosts(t *testing.T) {
+	hostKey := newTestHostKey(t)
+	otherKey := newTestHostKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	content := knownhosts.Line([]string{"deploy.example.com"}, hostKey) + "\n" +
+		knownhosts.Line([]string{"[other.example.com]:2222"}, otherKey)
+
+	verifier, err := NewHostKeyVerifier(content, "", "")
+	if err != nil {
+		t.Fatalf("NewHostKeyVerifier() returned unexpected error: %v", err)
+	}
+	cb := verifier.Callback()
+
+	if err := cb("deploy.example.com:22", remote, hostKey); err != nil {
+		t.Errorf("expected known key to be accepted, got: %v", err)
+	}
+
+	err = cb("deploy.example.com:22", remote, otherKey)
+	if err == nil {
+		t.Fatal("expected mismatched key to be rejected")
+	}
+	if !strings.Contains(err.Error(), ssh.FingerprintSHA256(otherKey)) || !strings.Contains(err.Error(), "ssh-ed25519") {
+		t.Errorf("error should show offered key type and fingerprint, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("error should report a mismatch, got: %v", err)
+	}
+
+	err = cb("unknown.example.com:22", remote, hostKey)
+	if err == nil || !strings.Contains(err.Error(), "not listed") {
+		t.Errorf("expected unknown host to be rejected, got: %v", err)
+	}
+
+	if err := cb("other.example.com:2222", remote, otherKey); err != nil {
+		t.Errorf("expected key on non-standard port to be accepted, got: %v", err)
+	}
+}
+
+func TestHostKeyVerifierKnownHostsPath(t *testing.T) {
+	hostKey := newTestHostKey(t)
+	workspace := t.TempDir()
+	t.Setenv("GITHUB_WORKSPACE", workspace)
+
+	line := knownhosts.Line([]string{"deploy.example.com"}, hostKey)
+	if err := os.WriteFile(filepath.Join(workspace, "known_hosts"), []byte(line+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write known_hosts: %v", err)
+	}
+
+	verifier, err := NewHostKeyVerifier("known_hosts", "", "")
+	if err != nil {
+		t.Fatalf("NewHostKeyVerifier() returned unexpected error: %v", err)
+	}
+	if err := verifier.Callback()("deploy.example.com:22", &net.TCPAddr{}, hostKey); err != nil {
+		t.Errorf("expected known key to be accepted, got: %v", err)
+	}
+
+	if _, err := NewHostKeyVerifier("missing_known_hosts", "", ""); err == nil {
+		t.Error("expected error for missing known_hosts file")
+	}
+}
+
+func TestHostKeyVerifierFingerprint(t *testing.T) {
+	hostKey := newTestHostKey(t)
+	otherKey := newTestHostKey(t)
+	fingerprint := ssh.FingerprintSHA256(hostKey)
+
+	tests := []struct {
+		name    string
+		pin     string
+		key     ssh.PublicKey
+		wantErr bool
+	}{
+		{name: "matching", pin: fingerprint, key: hostKey},
+		{name: "without_prefix", pin: strings.TrimPrefix(fingerprint, "SHA256:"), key: hostKey},
+		{name: "with_padding", pin: fingerprint + "=", key: hostKey},
+		{name: "one_of_many", pin: ssh.FingerprintSHA256(otherKey) + ", " + fingerprint, key: hostKey},
+		{name: "mismatch", pin: fingerprint, key: otherKey, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier, err := NewHostKeyVerifier("", tt.pin, "")
+			if err != nil {
+				t.Fatalf("NewHostKeyVerifier() returned unexpected error: %v", err)
+			}
+			err = verifier.Callback()("deploy.example.com:22", &net.TCPAddr{}, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Callback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	hostKey := newTestHostKey(t)
+	content := knownhosts.Line([]string{"deploy.example.com"}, hostKey)
+
+	verifier, err := NewHostKeyVerifier(content, "", "")
+	if err != nil {
+		t.Fatalf("NewHostKeyVerifier() returned unexpected error: %v", err)
+	}
+
+	algos := verifier.HostKeyAlgorithms("deploy.example.com:22")
+	if len(algos) != 1 || algos[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("HostKeyAlgorithms() = %v, want [%s]", algos, ssh.KeyAlgoED25519)
+	}
+
+	// Without a host CA certificates cannot be verified, so they are never
+	// asked for
+	if algos := verifier.HostKeyAlgorithms("unknown.example.com:22"); strings.Join(algos, ",") != strings.Join(plainAlgorithms, ",") {
+		t.Errorf("HostKeyAlgorithms() for unknown host = %v, want %v", algos, plainAlgorithms)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// jumpHostSpec is the JSON form of a jump host in the jump_hosts input
+type jumpHostSpec struct {
+	Host            string `json:"host"`
+	Port            int    `json:"port"`
+	User            string `json:"user"`
+	Key             string `json:"key"`
+	KeyPassphrase   string `json:"key_passphrase"`
+	Certificate     string `json:"certificate"`
+	KnownHosts      string `json:"known_hosts"`
+	HostFingerprint string `json:"host_fingerprint"`
+	HostCA          string `json:"host_ca"`
+}
+
+// ParseJumpHosts parses the jump_hosts input. It accepts either a JSON array
+// of objects with per-hop credentials, or a ProxyJump style list of
+// [user@]host[:port] entries separated by commas or newlines. Unset fields
+// are inherited from the target host when connecting.
+func ParseJumpHosts(value string) ([]SSHConfig, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(value, "[") && strings.Contains(value, "{") {
+		var specs []jumpHostSpec
+		if err := json.Unmarshal([]byte(value), &specs); err != nil {
+			return nil, fmt.Errorf("invalid jump_hosts JSON: %v", err)
+		}
+
+		hosts := make([]SSHConfig, 0, len(specs))
+		for i, spec := range specs {
+			if spec.Host == "" {
+				return nil, fmt.Errorf("jump host %d is missing required field: host", i+1)
+			}
+			hosts = append(hosts, SSHConfig{
+				User:            spec.User,
+				Key:             spec.Key,
+				KeyPassphrase:   spec.KeyPassphrase,
+				Certificate:     spec.Certificate,
+				Host:            spec.Host,
+				Port:            spec.Port,
+				KnownHosts:      spec.KnownHosts,
+				HostFingerprint: spec.HostFingerprint,
+				HostCA:          spec.HostCA,
+			})
+		}
+		return hosts, nil
+	}
+
+	var hosts []SSHConfig
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, err := parseJumpHost(entry)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// parseJumpHost parses a single [user@]host[:port] entry
+func parseJumpHost(entry string) (SSHConfig, error) {
+	var cfg SSHConfig
+	if at := strings.LastIndex(entry, "@"); at >= 0 {
+		cfg.User, entry = entry[:at], entry[at+1:]
+	}
+
+	cfg.Host = entry
+	if host, port, err := net.SplitHostPort(entry); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return SSHConfig{}, fmt.Errorf("invalid port in jump host %q", entry)
+		}
+		cfg.Host, cfg.Port = host, p
+	}
+
+	cfg.Host = strings.Trim(cfg.Host, "[]")
+	if cfg.Host == "" {
+		return SSHConfig{}, fmt.Errorf("invalid jump host %q", entry)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseJumpHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []SSHConfig
+		wantErr bool
+	}{
+		{name: "empty", value: "  "},
+		{
+			name:  "proxyjump_list",
+			value: "jump@bastion.example.com:2222, internal.example.com\n[fd00::1]:22",
+			want: []SSHConfig{
+				{User: "jump", Host: "bastion.example.com", Port: 2222},
+				{Host: "internal.example.com"},
+				{Host: "fd00::1", Port: 22},
+			},
+		},
+		{
+			name:  "json",
+			value: `[{"host": "bastion.example.com", "user": "jump", "port": 2200, "key": "KEY", "host_fingerprint": "SHA256:abc"}]`,
+			want: []SSHConfig{
+				{User: "jump", Host: "bastion.example.com", Port: 2200, Key: "KEY", HostFingerprint: "SHA256:abc"},
+			},
+		},
+		{name: "json_missing_host", value: `[{"user": "jump"}]`, wantErr: true},
+		{name: "invalid_json", value: `[{"host": }]`, wantErr: true},
+		{name: "invalid_port", value: "bastion.example.com:ssh", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseJumpHosts(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseJumpHosts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseJumpHosts() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Host != tt.want[i].Host || got[i].User != tt.want[i].User || got[i].Port != tt.want[i].Port ||
+					got[i].Key != tt.want[i].Key || got[i].HostFingerprint != tt.want[i].HostFingerprint {
+					t.Errorf("ParseJumpHosts()[%d] = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSSHConfigInherit(t *testing.T) {
+	target := SSHConfig{User: "deploy", Key: "KEY", KeyPassphrase: "pass", KnownHosts: "known", HostFingerprint: "SHA256:target"}
+
+	hop := SSHConfig{Host: "bastion"}.inherit(target)
+	if hop.User != "deploy" || hop.Port != 22 || hop.Key != "KEY" || hop.KeyPassphrase != "pass" || hop.KnownHosts != "known" {
+		t.Errorf("inherit() = %+v, expected target credentials", hop)
+	}
+	if hop.HostFingerprint != "" {
+		t.Error("inherit() should not copy the target host fingerprint")
+	}
+
+	hop = SSHConfig{Host: "bastion", User: "jump", Key: "JUMPKEY", HostFingerprint: "SHA256:jump"}.inherit(target)
+	if hop.User != "jump" || hop.Key != "JUMPKEY" || hop.KeyPassphrase != "" || hop.KnownHosts != "" {
+		t.Errorf("inherit() = %+v, expected jump host credentials to be kept", hop)
+	}
+}
+
+func TestCreateSSHClientThroughJumpHosts(t *testing.T) {
+	bastion := newTestSSHServer(t)
+	inner := newTestSSHServer(t)
+	target := newTestSSHServer(t)
+
+	if err := os.WriteFile(filepath.Join(target.Dir, "marker"), []byte("target"), 0644); err != nil {
+		t.Fatalf("failed to write marker: %v", err)
+	}
+
+	cfg := target.testSSHConfig(t)
+	bastionCfg := bastion.testSSHConfig(t)
+	bastionCfg.Key = "" // inherit the target key
+	innerCfg := inner.testSSHConfig(t)
+	cfg.JumpHosts = []SSHConfig{bastionCfg, innerCfg}
+
+	client, err := CreateSSHClient(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("CreateSSHClient() returned unexpected error: %v", err)
+	}
+	defer client.Close()
+
+	if len(client.jumps) != 2 {
+		t.Errorf("expected 2 jump connections, got %d", len(client.jumps))
+	}
+
+	result, err := client.RunCommand(context.Background(), "cat marker")
+	if err != nil {
+		t.Fatalf("RunCommand() returned unexpected error: %v", err)
+	}
+	if result.Stdout != "target" {
+		t.Errorf("RunCommand() = %q, want output from target host", result.Stdout)
+	}
+
+	// A jump host with an unknown host key must abort the connection
+	cfg.JumpHosts = []SSHConfig{{Host: "127.0.0.1", Port: bastion.Port(), KnownHosts: target.KnownHosts()}}
+	if _, err := CreateSSHClient(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "jump host") {
+		t.Errorf("expected jump host verification error, got: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// lockFile marks the remote directory as being deployed to, relative to
+	// the remote directory
+	lockFile = "deploy.lock"
+	// lockGrace is added to deploy_timeout for the work that still runs
+	// after it expired (rollback, history, cleanup) to decide when a lock
+	// is stale
+	lockGrace = 10 * time.Minute
+)
+
+// lockPollInterval is the delay between two attempts to take a held lock
+var lockPollInterval = 5 * time.Second
+
+// lockHolder is the content of the lock file
+type lockHolder struct {
+	ID         string     `json:"id"`
+	Mode       string     `json:"mode"`
+	RunID      string     `json:"run_id,omitempty"`
+	Actor      string     `json:"actor,omitempty"`
+	Ref        string     `json:"ref,omitempty"`
+	AcquiredAt time.Time  `json:"acquired_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+func (h lockHolder) String() string {
+	s := fmt.Sprintf("%s by run %s of %s", h.Mode, orDash(h.RunID), orDash(h.Actor))
+	if h.Ref != "" {
+		s += " on " + h.Ref
+	}
+	return s + " since " + h.AcquiredAt.UTC().Format(time.RFC3339)
+}
+
+// stale reports whether the holder is past the point where its run must
+// have ended. Locks without an expiry never become stale.
+func (h lockHolder) stale(now time.Time) bool {
+	return h.ExpiresAt != nil && now.After(*h.ExpiresAt)
+}
+
+// acquireLock takes the deploy lock of the remote directory. A held lock is
+// waited for up to timeout, or fails right away when timeout is 0; stale
+// locks are removed.
+func (d *Deployment) acquireLock(ctx context.Context, timeout time.Duration) error {
+	now := time.Now().UTC().Truncate(time.Second)
+	holder := lockHolder{
+		ID:         randomSuffix(),
+		Mode:       d.Inputs.Mode,
+		RunID:      d.Inputs.RunID,
+		Actor:      d.Inputs.Actor,
+		Ref:        d.Inputs.Ref,
+		AcquiredAt: now,
+	}
+	if d.Inputs.DeployTimeout > 0 {
+		// Waiting for the lock counts against deploy_timeout
+		expires := now.Add(d.Inputs.DeployTimeout + lockGrace)
+		holder.ExpiresAt = &expires
+	}
+	data, err := json.Marshal(holder)
+	if err != nil {
+		return fmt.Errorf("failed to encode the lock: %v", err)
+	}
+
+	// set -C makes the redirection fail if the file exists, so exactly one
+	// run creates it. Otherwise the holder is printed, or "released" if the
+	// lock disappeared in between.
+	cmd := fmt.Sprintf("mkdir -p %s && ", shellQuote(d.Inputs.RemoteDir)) + d.inRemoteDir(
+		fmt.Sprintf("if (set -C; printf '%%s\\n' %[1]s > %[2]s) 2>/dev/null; then echo acquired; else cat %[2]s 2>/dev/null || echo released; fi", shellQuote(string(data)), lockFile))
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		result, err := d.Client.RunCommand(ctx, cmd)
+		if err != nil {
+			return commandError("lock", result, err)
+		}
+		content := strings.TrimSpace(result.Stdout)
+		switch content {
+		case "acquired":
+			d.lock = string(data)
+			log(fmt.Sprintf("Acquired the deploy lock %s", d.remotePath(lockFile)))
+			return nil
+		case "released":
+			continue
+		}
+
+		var other lockHolder
+		if err := json.Unmarshal([]byte(content), &other); err != nil {
+			return fmt.Errorf("%s exists but cannot be read (%v); remove it with mode force_unlock", d.remotePath(lockFile), err)
+		}
+		if other.stale(time.Now()) {
+			logWarning(fmt.Sprintf("Removing the stale deploy lock held by %s", other))
+			if err := d.removeLock(ctx, content); err != nil {
+				return err
+			}
+			continue
+		}
+		if timeout == 0 {
+			return fmt.Errorf("another deployment is in progress: %s holds %s", other, d.remotePath(lockFile))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for the deploy lock held by %s", timeout, other)
+		}
+		if !waiting {
+			log(fmt.Sprintf("Waiting up to %s for the deploy lock held by %s", timeout, other))
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// removeLock deletes the lock file if it still has the given content, so a
+// lock taken by someone else in the meantime stays
+func (d *Deployment) removeLock(ctx context.Context, content string) error {
+	cmd := d.inRemoteDir(fmt.Sprintf(`if [ "$(cat %[1]s 2>/dev/null)" = %[2]s ]; then rm -f %[1]s; fi`, lockFile, shellQuote(content)))
+	if result, err := d.Client.RunCommand(ctx, cmd); err != nil {
+		return commandError("unlock", result, err)
+	}
+	return nil
+}
+
+// releaseLock gives the lock taken by acquireLock back, even if ctx is
+// already done. Failing to do so only logs a warning.
+func (d *Deployment) releaseLock(ctx context.Context) {
+	if d.lock == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+	if err := d.removeLock(ctx, d.lock); err != nil {
+		logWarning(fmt.Sprintf("Failed to release the deploy lock %s: %v", d.remotePath(lockFile), err))
+		return
+	}
+	d.lock = ""
+	log(fmt.Sprintf("Released the deploy lock %s", d.remotePath(lockFile)))
+}
+
+// ForceUnlock removes the deploy lock whoever holds it
+func (d *Deployment) ForceUnlock(ctx context.Context) error {
+	cmd := fmt.Sprintf("if [ -e %[1]s ]; then cat %[1]s && rm -f %[1]s; fi", shellQuote(d.remotePath(lockFile)))
+	result, err := d.Client.RunCommand(ctx, cmd)
+	if err != nil {
+		return commandError("unlock", result, err)
+	}
+	content := strings.TrimSpace(result.Stdout)
+	if content == "" {
+		log(fmt.Sprintf("No deploy lock in %s", d.Inputs.RemoteDir))
+		return nil
+	}
+
+	var holder lockHolder
+	if err := json.Unmarshal([]byte(content), &holder); err != nil {
+		logWarning(fmt.Sprintf("Removed the unreadable deploy lock %s", d.remotePath(lockFile)))
+		return nil
+	}
+	logWarning(fmt.Sprintf("Removed the deploy lock held by %s", holder))
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeploymentLock(t *testing.T) {
+	lockPollInterval = time.Millisecond
+	t.Cleanup(func() { lockPollInterval = 5 * time.Second })
+
+	server, client := newTestClient(t)
+
+	newDeployment := func(runID string) *Deployment {
+		return &Deployment{
+			Inputs: &Inputs{Mode: ModeDeploy, RemoteDir: "stack", RunID: runID, Actor: "octocat", DeployTimeout: time.Hour},
+			Client: client,
+		}
+	}
+	lockPath := filepath.Join(server.Dir, "stack", lockFile)
+
+	first := newDeployment("1")
+	if err := first.acquireLock(context.Background(), 0); err != nil {
+		t.Fatalf("acquireLock() returned unexpected error: %v", err)
+	}
+	var holder lockHolder
+	if data, err := os.ReadFile(lockPath); err != nil || json.Unmarshal(data, &holder) != nil {
+		t.Fatalf("lock file not written: %q, %v", data, err)
+	}
+	if holder.RunID != "1" || holder.Actor != "octocat" || holder.ExpiresAt == nil {
+		t.Errorf("lock holder = %+v", holder)
+	}
+
+	// A held lock fails right away, or after waiting for it
+	second := newDeployment("2")
+	if err := second.acquireLock(context.Background(), 0); err == nil || !strings.Contains(err.Error(), "deploy by run 1 of octocat") {
+		t.Errorf("acquireLock() error = %v, want the holder", err)
+	}
+	if err := second.acquireLock(context.Background(), 20*time.Millisecond); err == nil || !strings.Contains(err.Error(), "timed out after 20ms") {
+		t.Errorf("acquireLock() error = %v, want timeout", err)
+	}
+
+	// The waiting run gets the lock once it is released
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		first.releaseLock(context.Background())
+	}()
+	if err := second.acquireLock(context.Background(), time.Minute); err != nil {
+		t.Fatalf("acquireLock() after release returned unexpected error: %v", err)
+	}
+
+	// Releasing a lock taken over by someone else leaves it alone
+	first.lock = second.lock + " "
+	first.releaseLock(context.Background())
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Errorf("lock of another run removed: %v", err)
+	}
+	second.releaseLock(context.Background())
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("lock not released: %v", err)
+	}
+}
+
+func TestDeploymentStaleLock(t *testing.T) {
+	server, client := newTestClient(t)
+
+	lockPath := filepath.Join(server.Dir, lockFile)
+	expired := time.Now().Add(-time.Minute)
+	stale, _ := json.Marshal(lockHolder{ID: "old", Mode: ModeDeploy, RunID: "1", AcquiredAt: expired.Add(-time.Hour), ExpiresAt: &expired})
+	if err := os.WriteFile(lockPath, append(stale, '\n'), 0644); err != nil {
+		t.Fatalf("failed to write lock: %v", err)
+	}
+
+	d := &Deployment{Inputs: &Inputs{Mode: ModeDeploy, RemoteDir: ".", RunID: "2"}, Client: client}
+	if err := d.acquireLock(context.Background(), 0); err != nil {
+		t.Fatalf("acquireLock() over a stale lock returned unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(lockPath); !strings.Contains(string(data), `"run_id":"2"`) {
+		t.Errorf("lock = %q, want run 2", data)
+	}
+
+	// Without deploy_timeout the lock never expires and only force_unlock
+	// removes it
+	other := &Deployment{Inputs: &Inputs{Mode: ModeDeploy, RemoteDir: "."}, Client: client}
+	if err := other.acquireLock(context.Background(), 0); err == nil {
+		t.Error("acquireLock() should fail while the lock is held")
+	}
+	if err := other.ForceUnlock(context.Background()); err != nil {
+		t.Fatalf("ForceUnlock() returned unexpected error: %v", err)
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("lock not removed: %v", err)
+	}
+	if err := other.ForceUnlock(context.Background()); err != nil {
+		t.Errorf("ForceUnlock() without a lock returned unexpected error: %v", err)
+	}
+}
@@ -1,135 +1,191 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // log prints a message to stdout with GitHub Actions format
 func log(msg string) {
-	fmt.Printf("::notice::%s\n", msg)
+	logCommand("notice", msg)
+}
+
+// logWarning prints a warning message to stdout with GitHub Actions format
+func logWarning(msg string) {
+	logCommand("warning", msg)
 }
 
 // logError prints an error message to stdout with GitHub Actions format
 func logError(msg string) {
-	fmt.Printf("::error::%s\n", msg)
+	logCommand("error", msg)
 }
 
-func createEnvFile(dockerTag string) (string, error) {
-	// Create a temporary file
-	tmpDir := os.TempDir()
-	envFile := filepath.Join(tmpDir, ".env")
-
-	// Write the DOCKER_TAG to the .env file
-	content := fmt.Sprintf("DOCKER_TAG=%s\n", dockerTag)
-	if err := os.WriteFile(envFile, []byte(content), 0644); err != nil {
-		return "", fmt.Errorf("failed to create .env file: %v", err)
+// logCommand prints msg as the workflow command cmd. Only the first line
+// belongs to the command; further lines often quote remote output (stderr
+// tails, container logs), so they are printed with workflow commands
+// disabled, as when streaming.
+func logCommand(cmd, msg string) {
+	first, rest, multiline := strings.Cut(msg, "\n")
+	fmt.Printf("::%s::%s\n", cmd, first)
+	if multiline {
+		token := randomSuffix()
+		fmt.Printf("::stop-commands::%s\n%s\n::%s::\n", token, rest, token)
 	}
+}
 
-	return envFile, nil
+// envDuration reads a duration from the environment. Values may be Go
+// durations ("90s", "2m") or plain seconds; empty values yield def.
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return def, nil
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		value = fmt.Sprintf("%ds", seconds)
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration for %s: %q", key, value)
+	}
+	return d, nil
 }
 
-func validateFiles(client *SSHClient, files ...string) error {
-	// Build ls command for all files
-	cmd := fmt.Sprintf("ls -l %s", strings.Join(files, " "))
-	output, err := client.RunCommand(cmd)
-	if err != nil {
-		return fmt.Errorf("failed to validate files: %v", err)
+// envInt reads a non-negative integer from the environment; empty values yield def
+func envInt(key string, def int) (int, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return def, nil
 	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number for %s: %q", key, value)
+	}
+	return n, nil
+}
 
-	// Check if any files are missing from the output
-	for _, file := range files {
-		if !strings.Contains(output, file) {
-			return fmt.Errorf("file %s not found in remote directory", file)
+// parseList splits a multi-line input into its non-empty entries, ignoring
+// lines starting with #
+func parseList(value string) []string {
+	var items []string
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			items = append(items, line)
 		}
 	}
-
-	return nil
+	return items
 }
 
-func main() {
-	config := map[string]string{
-		"sshUser":     "SSH_USER",
-		"sshKey":      "SSH_KEY",
-		"sshHost":     "SSH_HOST",
-		"sshPort":     "SSH_PORT",
-		"composeFile": "COMPOSE_FILE",
-		"dockerTag":   "DOCKER_TAG",
-	}
-
-	for k, v := range config {
-		t := os.Getenv(v)
-		if t == "" {
-			logError(fmt.Sprintf("Missing required environment variable: %s", v))
-			os.Exit(1)
-		}
-		config[k] = t
+// setOutput writes an action output to the GITHUB_OUTPUT file. Multi-line
+// values use the heredoc syntax. Outside of GitHub Actions it does nothing.
+func setOutput(name, value string) error {
+	outputFile := os.Getenv("GITHUB_OUTPUT")
+	if outputFile == "" {
+		return nil
 	}
 
-	sshPort, err := strconv.Atoi(config["sshPort"])
+	f, err := os.OpenFile(outputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		logError(fmt.Sprintf("Invalid SSH port: %v", err))
-		os.Exit(1)
+		return fmt.Errorf("failed to open GITHUB_OUTPUT: %v", err)
 	}
+	defer f.Close()
 
-	// Create SSH client
-	client, err := CreateSSHClient(config["sshUser"], config["sshKey"], config["sshHost"], sshPort)
+	if strings.Contains(value, "\n") {
+		delimiter := fmt.Sprintf("ghadelimiter_%d", time.Now().UnixNano())
+		_, err = fmt.Fprintf(f, "%s<<%s\n%s\n%s\n", name, delimiter, value, delimiter)
+	} else {
+		_, err = fmt.Fprintf(f, "%s=%s\n", name, value)
+	}
 	if err != nil {
-		logError(fmt.Sprintf("Failed to create SSH client: %v", err))
-		os.Exit(1)
+		return fmt.Errorf("failed to write output %s: %v", name, err)
 	}
-	defer client.Close()
+	return nil
+}
 
-	// Create and transfer .env file with DOCKER_TAG
-	envFile, err := createEnvFile(config["dockerTag"])
+func main() {
+	inputs, err := loadInputs()
 	if err != nil {
-		logError(fmt.Sprintf("Failed to create .env file: %v", err))
+		logError(fmt.Sprintf("Invalid configuration: %v", err))
 		os.Exit(1)
 	}
-	defer os.Remove(envFile) // Clean up temporary file
-
-	if err := client.TransferFileWithRemotePath(envFile, ".env"); err != nil {
-		logError(fmt.Sprintf("Failed to transfer .env file: %v", err))
-		os.Exit(1)
+	// Mask the .env values before anything else is logged
+	maskEnv(inputs.Env)
+
+	// Cancel the deploy when the runner stops the job, which sends SIGINT or
+	// SIGTERM, or when deploy_timeout expires
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if inputs.DeployTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, inputs.DeployTimeout)
+		defer cancel()
 	}
-	log("Successfully transferred .env file")
 
-	// Transfer docker-compose file
-	remoteComposeFile := filepath.Base(config["composeFile"])
-	if err := client.TransferFileWithRemotePath(config["composeFile"], remoteComposeFile); err != nil {
-		logError(fmt.Sprintf("Failed to transfer docker-compose file: %v", err))
+	// Create SSH client
+	client, err := CreateSSHClient(ctx, inputs.SSH)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to create SSH client: %v", err))
 		os.Exit(1)
 	}
-	log(fmt.Sprintf("Successfully transferred docker-compose file: %s", remoteComposeFile))
+	defer client.Close()
+	client.CommandTimeout = inputs.CommandTimeout
+	client.TransferMethod = inputs.TransferMethod
+	client.SCPPath = inputs.SCPPath
+	log(fmt.Sprintf("Connected to %s as %s using %s", inputs.SSH.Host, inputs.SSH.User, client.identity))
+	for _, jump := range inputs.SSH.JumpHosts {
+		log(fmt.Sprintf("Tunneled through jump host %s", jump.Host))
+	}
 
-	// Validate transferred files
-	filesToValidate := []string{".env", remoteComposeFile}
-	if err := validateFiles(client, filesToValidate...); err != nil {
-		logError(fmt.Sprintf("File validation failed: %v", err))
-		os.Exit(1)
+	deployment := &Deployment{Inputs: inputs, Client: client}
+	switch inputs.Mode {
+	case ModeHistory:
+		if err := deployment.History(ctx, inputs.HistoryLimit); err != nil {
+			logError(fmt.Sprintf("Failed to read the deployment history: %v", err))
+			client.Close()
+			os.Exit(1)
+		}
+		return
+	case ModeForceUnlock:
+		if err := deployment.ForceUnlock(ctx); err != nil {
+			logError(fmt.Sprintf("Failed to remove the deploy lock: %v", err))
+			client.Close()
+			os.Exit(1)
+		}
+		return
 	}
-	log(fmt.Sprintf("Successfully validated files: %s", strings.Join(filesToValidate, ", ")))
 
-	// Run docker compose pull
-	log("Running docker compose pull...")
-	pullCmd := fmt.Sprintf("docker compose -f %s pull", remoteComposeFile)
-	pullOutput, err := client.RunCommand(pullCmd)
-	if err != nil {
-		logError(fmt.Sprintf("Failed to run docker compose pull: %v\nOutput: %s", err, pullOutput))
+	// Only one run at a time deploys to the remote directory
+	if err := deployment.acquireLock(ctx, inputs.LockTimeout); err != nil {
+		logError(fmt.Sprintf("Failed to acquire the deploy lock: %v", err))
+		client.Close()
 		os.Exit(1)
 	}
-	log(fmt.Sprintf("Successfully pulled Docker images:\n%s", pullOutput))
 
-	// Run docker compose up -d
-	log("Running docker compose up -d...")
-	upCmd := fmt.Sprintf("docker compose -f %s up -d", remoteComposeFile)
-	upOutput, err := client.RunCommand(upCmd)
+	run := deployment.Run
+	if inputs.Mode == ModeRollback {
+		run = func(ctx context.Context) error { return deployment.Rollback(ctx, inputs.RollbackSteps) }
+	}
+	started := time.Now()
+	err = run(ctx)
+	deployment.recordHistory(ctx, started, err)
+	deployment.releaseLock(ctx)
 	if err != nil {
-		logError(fmt.Sprintf("Failed to run docker compose up: %v\nOutput: %s", err, upOutput))
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			logError(fmt.Sprintf("Deployment timed out after %s: %v", inputs.DeployTimeout, err))
+		case errors.Is(ctx.Err(), context.Canceled):
+			logError(fmt.Sprintf("Deployment cancelled: %v", err))
+		default:
+			logError(fmt.Sprintf("Deployment failed: %v", err))
+		}
+		client.Close()
 		os.Exit(1)
 	}
-	log(fmt.Sprintf("Successfully started Docker containers:\n%s", upOutput))
 }
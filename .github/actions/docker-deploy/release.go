@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// releasesDir holds one directory per release, relative to the remote
+	// directory
+	releasesDir = "releases"
+	// currentLink is the symlink to the live release, relative to the
+	// remote directory
+	currentLink = "current"
+	// releaseComposeList lists the compose files of a release, in order
+	releaseComposeList = ".compose-files"
+	// rollbackTimeout bounds an automatic rollback, which also runs after the
+	// deploy timed out or was cancelled
+	rollbackTimeout = 5 * time.Minute
+)
+
+var (
+	releaseNamePattern = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}\.[0-9]{3}Z-.+$`)
+	unsafeTagChars     = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+)
+
+// release is the directory of one deployment, named <timestamp>-<tag> so
+// that names sort by deploy time
+type release struct {
+	ID  string
+	Tag string
+}
+
+// newRelease names a release of tag deployed at t
+func newRelease(tag string, t time.Time) release {
+	id := t.UTC().Format("20060102T150405.000Z") + "-" + unsafeTagChars.ReplaceAllString(tag, "_")
+	return release{ID: id, Tag: tag}
+}
+
+// parseRelease reads the tag back from a release name
+func parseRelease(name string) (release, bool) {
+	if !releaseNamePattern.MatchString(name) {
+		return release{}, false
+	}
+	_, tag, _ := strings.Cut(name, "-")
+	return release{ID: name, Tag: tag}, true
+}
+
+// dir returns the release directory relative to the remote directory
+func (r release) dir() string {
+	return path.Join(releasesDir, r.ID)
+}
+
+// inRemoteDir prefixes cmd to run in the remote directory
+func (d *Deployment) inRemoteDir(cmd string) string {
+	return fmt.Sprintf("cd %s && %s", shellQuote(d.Inputs.RemoteDir), cmd)
+}
+
+// listReleases returns the releases, oldest first
+func (d *Deployment) listReleases(ctx context.Context) ([]release, error) {
+	cmd := d.inRemoteDir(fmt.Sprintf("if [ -d %[1]s ]; then ls -1 %[1]s; fi", releasesDir))
+	result, err := d.Client.RunCommand(ctx, cmd)
+	if err != nil {
+		return nil, commandError("ls releases", result, err)
+	}
+
+	var releases []release
+	for _, name := range strings.Fields(result.Stdout) {
+		if r, ok := parseRelease(name); ok {
+			releases = append(releases, r)
+		}
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].ID < releases[j].ID })
+	return releases, nil
+}
+
+// currentRelease returns the release current points to, or nil
+func (d *Deployment) currentRelease(ctx context.Context) (*release, error) {
+	cmd := d.inRemoteDir(fmt.Sprintf("if [ -L %[1]s ]; then readlink %[1]s; fi", currentLink))
+	result, err := d.Client.RunCommand(ctx, cmd)
+	if err != nil {
+		return nil, commandError("readlink current", result, err)
+	}
+	target := strings.TrimSpace(result.Stdout)
+	if target == "" {
+		return nil, nil
+	}
+	r, ok := parseRelease(path.Base(target))
+	if !ok {
+		return nil, fmt.Errorf("%s points to %s, which is not a release", currentLink, target)
+	}
+	return &r, nil
+}
+
+// liveTag returns DOCKER_TAG from the live .env, or "" if there is none
+func (d *Deployment) liveTag(ctx context.Context) string {
+	vars, err := d.readRemoteEnv(ctx)
+	if err != nil {
+		logWarning(fmt.Sprintf("Cannot read the deployed tag: %v", err))
+		return ""
+	}
+	for _, v := range vars {
+		if v.Key == "DOCKER_TAG" {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+// recordPrevious returns the live release before anything changes, and sets
+// the previous_tag output. Hosts deployed before release directories have
+// their .env, compose and extra files copied into a release first.
+func (d *Deployment) recordPrevious(ctx context.Context) (*release, error) {
+	tag := d.liveTag(ctx)
+	if err := setOutput("previous_tag", tag); err != nil {
+		return nil, err
+	}
+
+	previous, err := d.currentRelease(ctx)
+	if err != nil || previous != nil {
+		if previous != nil {
+			log(fmt.Sprintf("Previous release: %s", previous.ID))
+		}
+		return previous, err
+	}
+	if tag == "" {
+		return nil, nil
+	}
+
+	// The legacy stack used the same layout as the new release: extra files
+	// next to the first compose file, at the top of the remote directory
+	extra, err := resolveExtraFiles(filepath.Dir(d.Inputs.ComposeFiles[0]), d.Inputs.ExtraFiles)
+	if err != nil {
+		return nil, err
+	}
+	legacy := newRelease(tag, time.Now())
+	files := append(append([]string{".env"}, d.composeFiles...), extra...)
+	if err := d.saveRelease(ctx, legacy, files); err != nil {
+		return nil, err
+	}
+	log(fmt.Sprintf("Recorded the deployed tag %s as release %s", tag, legacy.ID))
+	return &legacy, nil
+}
+
+// saveRelease copies files and directories of the remote directory into
+// release r, skipping missing ones. The release is built under a temporary name and renamed, so
+// it is either complete or absent.
+func (d *Deployment) saveRelease(ctx context.Context, r release, files []string) error {
+	tmp := path.Join(releasesDir, ".tmp-"+r.ID)
+	script := fmt.Sprintf(`rm -rf %[1]s && mkdir -p %[1]s && `+
+		`for f in %[3]s; do if [ -e "$f" ]; then mkdir -p %[1]s/"$(dirname "$f")" && cp -pR "$f" %[1]s/"$f" || exit 1; fi; done && `+
+		`printf '%%s\n' %[4]s > %[1]s/%[5]s && mv %[1]s %[2]s`,
+		shellQuote(tmp), shellQuote(r.dir()), strings.Join(quoteAll(files), " "), strings.Join(quoteAll(d.composeFiles), " "), releaseComposeList)
+	if result, err := d.Client.RunCommand(ctx, d.inRemoteDir(script)); err != nil {
+		return commandError("save release", result, err)
+	}
+	return nil
+}
+
+// activate records the compose files of release r and atomically points
+// current to it: a new symlink is renamed over the old one. mv -T is GNU
+// specific; elsewhere the link is replaced in two steps.
+func (d *Deployment) activate(ctx context.Context, r release, composeFiles []string) error {
+	tmp := currentLink + ".tmp"
+	script := fmt.Sprintf(`printf '%%s\n' %[1]s > %[2]s/%[3]s && rm -f %[4]s && ln -s %[2]s %[4]s && `+
+		`{ mv -Tf %[4]s %[5]s 2>/dev/null || { rm -f %[5]s && mv -f %[4]s %[5]s; }; }`,
+		strings.Join(quoteAll(composeFiles), " "), shellQuote(r.dir()), releaseComposeList, tmp, currentLink)
+	if result, err := d.Client.RunCommand(ctx, d.inRemoteDir(script)); err != nil {
+		return commandError("switch current", result, err)
+	}
+	log(fmt.Sprintf("Switched %s to %s", d.remotePath(currentLink), r.dir()))
+	return nil
+}
+
+// removeRelease deletes the directory of a failed release, even if ctx is
+// already done, and reports whether it is gone
+func (d *Deployment) removeRelease(ctx context.Context, r release) bool {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+	if result, err := d.Client.RunCommand(ctx, d.inRemoteDir("rm -rf "+shellQuote(r.dir()))); err != nil {
+		logWarning(fmt.Sprintf("Failed to remove release %s: %v", r.ID, commandError("rm", result, err)))
+		return false
+	}
+	return true
+}
+
+// mountedReleases returns the IDs of the releases that containers of the
+// project mount files from. Bind mounts are resolved when a container is
+// created, so a container that was not recreated by later deploys, e.g. a
+// service left out of the services input, still uses the release it was
+// started from.
+func (d *Deployment) mountedReleases(ctx context.Context) (map[string]bool, error) {
+	cmd := d.inComposeDir(fmt.Sprintf(`ids=$(docker ps -aq --filter label=com.docker.compose.project=%s) && if [ -n "$ids" ]; then docker inspect --format %s $ids; fi`,
+		d.projectWord(), shellQuote("{{range .Mounts}}{{println .Source}}{{end}}")))
+	result, err := d.Client.RunCommand(ctx, cmd)
+	if err != nil {
+		return nil, commandError("docker inspect", result, err)
+	}
+
+	mounted := map[string]bool{}
+	for _, source := range strings.Fields(result.Stdout) {
+		parts := strings.Split(source, "/")
+		for i := 0; i+1 < len(parts); i++ {
+			if r, ok := parseRelease(parts[i+1]); ok && parts[i] == releasesDir {
+				mounted[r.ID] = true
+			}
+		}
+	}
+	return mounted, nil
+}
+
+// pruneReleases removes all but the newest KeepReleases releases. The
+// release current points to and releases still mounted by containers are
+// always kept.
+func (d *Deployment) pruneReleases(ctx context.Context) error {
+	releases, err := d.listReleases(ctx)
+	if err != nil || len(releases) <= d.Inputs.KeepReleases {
+		return err
+	}
+	current, err := d.currentRelease(ctx)
+	if err != nil {
+		return err
+	}
+
+	var candidates []release
+	for _, r := range releases[:len(releases)-d.Inputs.KeepReleases] {
+		if current == nil || r.ID != current.ID {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	mounted, err := d.mountedReleases(ctx)
+	if err != nil {
+		return err
+	}
+
+	var old, kept, dirs []string
+	for _, r := range candidates {
+		if mounted[r.ID] {
+			kept = append(kept, r.ID)
+			continue
+		}
+		old = append(old, r.ID)
+		dirs = append(dirs, shellQuote(r.dir()))
+	}
+	if len(kept) > 0 {
+		log(fmt.Sprintf("Keeping %d old releases still mounted by containers: %s", len(kept), strings.Join(kept, ", ")))
+	}
+	if len(old) == 0 {
+		return nil
+	}
+	if result, err := d.Client.RunCommand(ctx, d.inRemoteDir("rm -rf "+strings.Join(dirs, " "))); err != nil {
+		return commandError("remove old releases", result, err)
+	}
+	log(fmt.Sprintf("Removed %d old releases: %s", len(old), strings.Join(old, ", ")))
+	return nil
+}
+
+// restoreRelease points current back to r and starts services, or the
+// whole stack when none are given, with its compose files
+func (d *Deployment) restoreRelease(ctx context.Context, r release, services []string) error {
+	result, err := d.Client.RunCommand(ctx, d.inRemoteDir("cat "+shellQuote(path.Join(r.dir(), releaseComposeList))))
+	if err != nil {
+		return commandError("read release", result, err)
+	}
+	composeFiles := strings.Fields(result.Stdout)
+	if len(composeFiles) == 0 {
+		return fmt.Errorf("release %s lists no compose file", r.ID)
+	}
+	if err := d.activate(ctx, r, composeFiles); err != nil {
+		return err
+	}
+	d.composeFiles = composeFiles
+
+	up := []string{"up", "-d"}
+	if d.Inputs.NoDeps && len(services) > 0 {
+		up = append(up, "--no-deps")
+	}
+	log(fmt.Sprintf("Running docker compose %s...", strings.Join(append(up, services...), " ")))
+	if result, err := d.Client.StreamCommand(ctx, d.composeCommand(append(up, quoteAll(services)...)...)); err != nil {
+		return commandError("docker compose up", result, err)
+	}
+	log("Successfully started Docker containers")
+	return nil
+}
+
+// rollbackAfter restores the previous release after the deploy failed with
+// deployErr, even if ctx is already done
+func (d *Deployment) rollbackAfter(ctx context.Context, deployErr error, previous *release) error {
+	logWarning(fmt.Sprintf("Deployment failed, rolling back to release %s: %v", previous.ID, deployErr))
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+	defer cancel()
+	// Only the deployed services were changed, the others keep running
+	if err := d.restoreRelease(ctx, *previous, d.Inputs.Services); err != nil {
+		return fmt.Errorf("%v\nRollback to %s failed: %v", deployErr, previous.ID, err)
+	}
+	d.rolledBack = true
+	if err := setOutput("rolled_back", "true"); err != nil {
+		return err
+	}
+	return fmt.Errorf("%v\nRolled back to %s", deployErr, previous.Tag)
+}
+
+// Rollback points current to the release steps releases before the live
+// one and starts it
+func (d *Deployment) Rollback(ctx context.Context, steps int) error {
+	releases, err := d.listReleases(ctx)
+	if err != nil {
+		return err
+	}
+	current, err := d.currentRelease(ctx)
+	if err != nil {
+		return err
+	}
+	live := len(releases) - 1
+	for i, r := range releases {
+		if current != nil && r.ID == current.ID {
+			live = i
+		}
+	}
+	if steps < 1 || steps > live {
+		return fmt.Errorf("cannot roll back %d releases: %d older releases kept", steps, max(live, 0))
+	}
+	target := releases[live-steps]
+	d.release = target
+	d.tag = target.Tag
+
+	if err := setOutput("previous_tag", d.liveTag(ctx)); err != nil {
+		return err
+	}
+	log(fmt.Sprintf("Rolling back %d releases to %s", steps, target.ID))
+	if err := d.restoreRelease(ctx, target, nil); err != nil {
+		return err
+	}
+	if result, err := d.Client.RunCommand(ctx, remoteChecksumCommand([]string{d.releasePath(d.composeFiles[0])})); err == nil {
+		if fields := strings.Fields(result.Stdout); len(fields) > 0 {
+			d.composeSHA256 = fields[0]
+		}
+	}
+
+	if d.Inputs.WaitTimeout > 0 {
+		services, err := d.stackServices(ctx)
+		if err != nil {
+			return err
+		}
+		if err := d.waitHealthy(ctx, services, d.Inputs.WaitTimeout); err != nil {
+			return err
+		}
+	}
+
+	log(fmt.Sprintf("Rolled back to %s", target.Tag))
+	return setOutput("rolled_back", "true")
+}
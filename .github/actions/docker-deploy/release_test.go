@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReleaseNames(t *testing.T) {
+	r := newRelease("feature/x:1", time.Date(2026, 3, 1, 12, 30, 5, 250e6, time.FixedZone("CET", 3600)))
+	if r.ID != "20260301T113005.250Z-feature_x_1" {
+		t.Errorf("newRelease() ID = %q", r.ID)
+	}
+
+	parsed, ok := parseRelease("20260301T113005.250Z-abc-1234")
+	if !ok || parsed.Tag != "abc-1234" {
+		t.Errorf("parseRelease() = %+v, %v", parsed, ok)
+	}
+	for _, name := range []string{".tmp-20260301T113005.250Z-abc", "20260301-abc", "current"} {
+		if _, ok := parseRelease(name); ok {
+			t.Errorf("parseRelease(%q) should not match", name)
+		}
+	}
+}
+
+func TestDeploymentRollback(t *testing.T) {
+	server, client := newTestClient(t)
+	client.logOutput = io.Discard
+	// Tag "broken" fails to start
+	dockerLog := fakeDocker(t, `case "$*" in
+*"config --services") echo api ;;
+*"up -d"*) echo "$*" >> "$DOCKER_LOG"; if grep -q DOCKER_TAG=broken .env; then echo "container exited" >&2; exit 1; fi ;;
+esac`)
+	outputFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", outputFile)
+
+	local := t.TempDir()
+	writeTestFiles(t, local, map[string]os.FileMode{"docker-compose.yml": 0644})
+	remoteEnv := filepath.Join(server.Dir, "stack", "current", ".env")
+
+	deploy := func(tag string, services ...string) error {
+		d := &Deployment{
+			Inputs: &Inputs{
+				ComposeFiles: []string{filepath.Join(local, "docker-compose.yml")},
+				Services:     services,
+				NoDeps:       len(services) > 0,
+				DockerTag:    tag,
+				RemoteDir:    "stack",
+				AutoRollback: true,
+				KeepReleases: 10,
+			},
+			Client: client,
+		}
+		return d.Run(context.Background())
+	}
+	for _, tag := range []string{"v1", "v2"} {
+		if err := deploy(tag); err != nil {
+			t.Fatalf("Run() for %s returned unexpected error: %v", tag, err)
+		}
+	}
+
+	// A failing deploy restores the previous release
+	os.Remove(outputFile)
+	err := deploy("broken")
+	if err == nil || !strings.Contains(err.Error(), "Rolled back to v2") {
+		t.Fatalf("Run() error = %v, want rollback to v2", err)
+	}
+	if got, _ := os.ReadFile(remoteEnv); string(got) != "DOCKER_TAG=v2\n" {
+		t.Errorf(".env after rollback = %q", got)
+	}
+	output, _ := os.ReadFile(outputFile)
+	for _, want := range []string{"previous_tag=v2\n", "rolled_back=true\n"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("outputs = %q, want %q", output, want)
+		}
+	}
+
+	// The failed release is removed
+	d := &Deployment{Inputs: &Inputs{RemoteDir: "stack"}, Client: client}
+	if got := releaseTags(t, d); got != "v1,v2" {
+		t.Errorf("release tags after rollback = %q, want v1,v2", got)
+	}
+
+	// Rolling back a selective deploy only restarts the deployed services
+	os.Remove(dockerLog)
+	if err := deploy("broken", "api"); err == nil || !strings.Contains(err.Error(), "Rolled back to v2") {
+		t.Fatalf("Run() error = %v, want rollback to v2", err)
+	}
+	compose := "compose -p stack -f docker-compose.yml"
+	if data, _ := os.ReadFile(dockerLog); string(data) != compose+" up -d --no-deps api\n"+compose+" up -d --no-deps api\n" {
+		t.Errorf("compose commands = %q, want up of api only", data)
+	}
+
+	// The rollback mode moves current N releases back from the live one
+	if err := d.Rollback(context.Background(), 2); err == nil {
+		t.Error("Rollback() past the oldest release should fail")
+	}
+	if err := d.Rollback(context.Background(), 1); err != nil {
+		t.Fatalf("Rollback() returned unexpected error: %v", err)
+	}
+	if got, _ := os.ReadFile(remoteEnv); string(got) != "DOCKER_TAG=v1\n" {
+		t.Errorf(".env after manual rollback = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(server.Dir, "stack", releaseComposeList)); !os.IsNotExist(err) {
+		t.Errorf("release metadata left in the remote directory: %v", err)
+	}
+	if got := releaseTags(t, d); got != "v1,v2" {
+		t.Errorf("release tags after manual rollback = %q, want v1,v2", got)
+	}
+}
+
+func TestPruneReleases(t *testing.T) {
+	_, client := newTestClient(t)
+	// The first container started mounts its release and is never recreated,
+	// like a service left out of the services input
+	dockerLog := fakeDocker(t, `case "$*" in
+*" up -d"*) [ -e "$DOCKER_LOG" ] || echo "$PWD/nginx.conf" > "$DOCKER_LOG" ;;
+"ps "*) if [ -e "$DOCKER_LOG" ]; then echo 3f1c; fi ;;
+"inspect "*) cat "$DOCKER_LOG" ;;
+esac`)
+	t.Setenv("GITHUB_OUTPUT", "")
+
+	local := t.TempDir()
+	writeTestFiles(t, local, map[string]os.FileMode{"docker-compose.yml": 0644})
+	d := &Deployment{
+		Inputs: &Inputs{
+			ComposeFiles: []string{filepath.Join(local, "docker-compose.yml")},
+			RemoteDir:    ".",
+			KeepReleases: 2,
+		},
+		Client: client,
+	}
+	for _, tag := range []string{"v1", "v2", "v3", "v4"} {
+		d.Inputs.DockerTag = tag
+		if err := d.Run(context.Background()); err != nil {
+			t.Fatalf("Run() for %s returned unexpected error: %v", tag, err)
+		}
+	}
+	if got := releaseTags(t, d); got != "v1,v3,v4" {
+		t.Errorf("release tags = %q, want v1,v3,v4", got)
+	}
+
+	// The live release is kept even when it is older than the rest
+	if err := d.Rollback(context.Background(), 1); err != nil {
+		t.Fatalf("Rollback() returned unexpected error: %v", err)
+	}
+	d.Inputs.KeepReleases = 1
+	if err := d.pruneReleases(context.Background()); err != nil {
+		t.Fatalf("pruneReleases() returned unexpected error: %v", err)
+	}
+	if got := releaseTags(t, d); got != "v1,v3,v4" {
+		t.Errorf("release tags after pruning = %q, want v1,v3,v4", got)
+	}
+
+	// Once no container mounts it, the release is removed
+	os.Remove(dockerLog)
+	if err := d.pruneReleases(context.Background()); err != nil {
+		t.Fatalf("pruneReleases() returned unexpected error: %v", err)
+	}
+	if got := releaseTags(t, d); got != "v3,v4" {
+		t.Errorf("release tags after the container was removed = %q, want v3,v4", got)
+	}
+}
+
+// releaseTags returns the tags of the remote releases, oldest first
+func releaseTags(t *testing.T, d *Deployment) string {
+	t.Helper()
+	releases, err := d.listReleases(context.Background())
+	if err != nil {
+		t.Fatalf("listReleases() returned unexpected error: %v", err)
+	}
+	var tags []string
+	for _, r := range releases {
+		tags = append(tags, r.Tag)
+	}
+	return strings.Join(tags, ",")
+}
+
+func TestDeploymentFailureBeforeSwitch(t *testing.T) {
+	server, client := newTestClient(t)
+	client.logOutput = io.Discard
+	// Pulling v3 fails
+	fakeDocker(t, `case "$*" in
+*"config --services") echo api ;;
+*" pull"*) if grep -q DOCKER_TAG=v3 .env; then exit 1; fi ;;
+*" up -d"*) echo "$*" >> "$DOCKER_LOG" ;;
+esac`)
+	outputFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", outputFile)
+
+	local := t.TempDir()
+	writeTestFiles(t, local, map[string]os.FileMode{"docker-compose.yml": 0644})
+	d := &Deployment{
+		Inputs: &Inputs{
+			ComposeFiles: []string{filepath.Join(local, "docker-compose.yml")},
+			DockerTag:    "v1",
+			RemoteDir:    ".",
+			KeepReleases: 10,
+		},
+		Client: client,
+	}
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+	live, err := os.Readlink(filepath.Join(server.Dir, currentLink))
+	if err != nil {
+		t.Fatalf("current is not a symlink: %v", err)
+	}
+
+	// An unknown service and a failed pull leave current and the running
+	// stack alone and drop the new release, with or without auto rollback
+	d.Inputs.DockerTag, d.Inputs.Services = "v2", []string{"apii"}
+	if err := d.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "services not defined") {
+		t.Errorf("Run() error = %v, want undefined service error", err)
+	}
+	os.Remove(outputFile)
+	d.Inputs.DockerTag, d.Inputs.Services, d.Inputs.AutoRollback = "v3", nil, true
+	if err := d.Run(context.Background()); err == nil || strings.Contains(err.Error(), "Rolled back") {
+		t.Errorf("Run() error = %v, want pull failure without rollback", err)
+	}
+	if output, _ := os.ReadFile(outputFile); !strings.Contains(string(output), "rolled_back=false\n") {
+		t.Errorf("outputs = %q, want rolled_back=false", output)
+	}
+
+	if got, _ := os.Readlink(filepath.Join(server.Dir, currentLink)); got != live {
+		t.Errorf("current = %q, want %q", got, live)
+	}
+	if got := releaseTags(t, d); got != "v1" {
+		t.Errorf("release tags = %q, want v1", got)
+	}
+	if data, _ := os.ReadFile(os.Getenv("DOCKER_LOG")); strings.Count(string(data), "up -d") != 1 {
+		t.Errorf("docker compose up ran after a failed check: %q", data)
+	}
+
+	// The history entry does not point to the removed release
+	d.recordHistory(context.Background(), time.Now(), errors.New("pull failed"))
+	entries, err := d.readHistory(context.Background())
+	if err != nil || len(entries) != 1 || entries[0].Release != "" || entries[0].Tag != "v3" {
+		t.Errorf("readHistory() = %+v, %v, want a v3 entry without release", entries, err)
+	}
+}
+
+func TestDeploymentLegacyMigration(t *testing.T) {
+	server, client := newTestClient(t)
+	client.logOutput = io.Discard
+	fakeDocker(t, "")
+	t.Setenv("GITHUB_OUTPUT", "")
+
+	// A host deployed before release directories, with an extra directory
+	remote := filepath.Join(server.Dir, "stack")
+	writeTestFiles(t, remote, map[string]os.FileMode{"docker-compose.yml": 0644, "nginx/default.conf": 0644})
+	if err := os.WriteFile(filepath.Join(remote, ".env"), []byte("DOCKER_TAG=old\n"), 0644); err != nil {
+		t.Fatalf("failed to write .env: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(remote, "nginx", "default.conf"), []byte("old config"), 0644); err != nil {
+		t.Fatalf("failed to write nginx config: %v", err)
+	}
+
+	local := t.TempDir()
+	writeTestFiles(t, local, map[string]os.FileMode{"docker-compose.yml": 0644, "nginx/default.conf": 0644})
+	d := &Deployment{
+		Inputs: &Inputs{
+			ComposeFiles: []string{filepath.Join(local, "docker-compose.yml")},
+			ExtraFiles:   []string{"nginx"},
+			DockerTag:    "v1",
+			RemoteDir:    "stack",
+			KeepReleases: 10,
+		},
+		Client: client,
+	}
+	if err := d.Run(context.Background()); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+	if got := releaseTags(t, d); got != "old,v1" {
+		t.Fatalf("release tags = %q, want old,v1", got)
+	}
+
+	// The legacy release holds everything the legacy stack used, so rolling
+	// back to it restores the extra files too
+	if err := d.Rollback(context.Background(), 1); err != nil {
+		t.Fatalf("Rollback() returned unexpected error: %v", err)
+	}
+	for name, want := range map[string]string{".env": "DOCKER_TAG=old\n", "docker-compose.yml": "content of docker-compose.yml", "nginx/default.conf": "old config"} {
+		if got, _ := os.ReadFile(filepath.Join(remote, currentLink, name)); string(got) != want {
+			t.Errorf("%s after rollback = %q, want %q", name, got, want)
+		}
+	}
+}
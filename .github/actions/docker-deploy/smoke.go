@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSmokeBody limits how much of a response body is searched
+const maxSmokeBody = 1 << 20
+
+// smokeRetryDelay is the delay between two attempts of a failing check
+var smokeRetryDelay = 5 * time.Second
+
+// smokeClient does not follow redirects, like curl without -L on the remote
+// host, so a check expects the same status from either side
+var smokeClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// SmokeCheck is an HTTP request that must answer with Status and, when set,
+// a body containing Body. Remote checks run with curl on the remote host.
+type SmokeCheck struct {
+	URL    string
+	Remote bool
+	Status int
+	Body   string
+}
+
+func (c SmokeCheck) String() string {
+	s := c.URL
+	if c.Remote {
+		s = "remote " + s
+	}
+	return s
+}
+
+// parseSmokeChecks parses the smoke_checks input, one check per line:
+//
+//	[runner|remote] URL [STATUS] [BODY]
+//
+// STATUS defaults to 200 and BODY is the rest of the line, optionally in
+// double quotes.
+func parseSmokeChecks(value string) ([]SmokeCheck, error) {
+	var checks []SmokeCheck
+	for _, line := range parseList(value) {
+		check := SmokeCheck{Status: http.StatusOK}
+
+		field, rest := cutField(line)
+		switch field {
+		case "remote":
+			check.Remote = true
+			field, rest = cutField(rest)
+		case "runner":
+			field, rest = cutField(rest)
+		}
+
+		u, err := url.Parse(field)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid smoke check %q: expected an http or https URL", line)
+		}
+		check.URL = field
+
+		if field, after := cutField(rest); field != "" {
+			if status, err := strconv.Atoi(field); err == nil {
+				if status < 100 || status > 599 {
+					return nil, fmt.Errorf("invalid smoke check %q: status %d out of range", line, status)
+				}
+				check.Status = status
+				rest = after
+			}
+		}
+		if body := strings.TrimSpace(rest); len(body) >= 2 && strings.HasPrefix(body, `"`) && strings.HasSuffix(body, `"`) {
+			check.Body = body[1 : len(body)-1]
+		} else {
+			check.Body = body
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// cutField splits off the first whitespace separated field of s
+func cutField(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// smokeResult is the outcome of one check after all attempts
+type smokeResult struct {
+	Check    SmokeCheck
+	Attempts int
+	Err      error
+}
+
+// runSmokeChecks runs every check, retrying each up to retries times, and
+// prints a report. It fails if any check does not pass.
+func (d *Deployment) runSmokeChecks(ctx context.Context, checks []SmokeCheck, retries int, timeout time.Duration) error {
+	log(fmt.Sprintf("Running %d smoke checks...", len(checks)))
+
+	var results []smokeResult
+	failed := 0
+	for _, check := range checks {
+		result := smokeResult{Check: check}
+		for {
+			result.Attempts++
+			result.Err = d.smokeCheck(ctx, check, timeout)
+			if result.Err == nil || result.Attempts > retries || ctx.Err() != nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(smokeRetryDelay):
+			}
+		}
+		if result.Err != nil {
+			failed++
+		}
+		results = append(results, result)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	var report strings.Builder
+	for _, r := range results {
+		attempts := "1 attempt"
+		if r.Attempts > 1 {
+			attempts = fmt.Sprintf("%d attempts", r.Attempts)
+		}
+		if r.Err != nil {
+			fmt.Fprintf(&report, "\n  FAIL %s: %v (%s)", r.Check, r.Err, attempts)
+		} else {
+			fmt.Fprintf(&report, "\n  PASS %s: status %d (%s)", r.Check, r.Check.Status, attempts)
+		}
+	}
+
+	if failed > 0 {
+		logError("Smoke checks failed:" + report.String())
+		return fmt.Errorf("%d of %d smoke checks failed", failed, len(checks))
+	}
+	log("Smoke checks passed:" + report.String())
+	return nil
+}
+
+// smokeCheck runs a single attempt of check
+func (d *Deployment) smokeCheck(ctx context.Context, check SmokeCheck, timeout time.Duration) error {
+	var status int
+	var body string
+	var err error
+	if check.Remote {
+		status, body, err = d.remoteRequest(ctx, check.URL, timeout)
+	} else {
+		status, body, err = runnerRequest(ctx, check.URL, timeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	if status != check.Status {
+		return fmt.Errorf("expected status %d, got %d", check.Status, status)
+	}
+	if check.Body != "" && !strings.Contains(body, check.Body) {
+		return fmt.Errorf("response body does not contain %q", check.Body)
+	}
+	return nil
+}
+
+// runnerRequest requests target from the runner; a timeout of 0 means no limit
+func runnerRequest(ctx context.Context, target string, timeout time.Duration) (int, string, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	resp, err := smokeClient.Do(req)
+	if err != nil {
+		return 0, "", fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSmokeBody))
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read response: %v", err)
+	}
+	return resp.StatusCode, string(body), nil
+}
+
+// remoteRequest requests target with curl on the remote host, for endpoints
+// only reachable from there. curl prints the status code on a last line of
+// its own after the body.
+func (d *Deployment) remoteRequest(ctx context.Context, target string, timeout time.Duration) (int, string, error) {
+	cmd := "curl -sS"
+	if timeout > 0 {
+		cmd += fmt.Sprintf(" --max-time %d", int(math.Ceil(timeout.Seconds())))
+	}
+	cmd += fmt.Sprintf(` -w '\n%%{http_code}' %s`, shellQuote(target))
+
+	result, err := d.Client.RunCommand(ctx, cmd)
+	if err != nil {
+		if result.ExitCode == 127 {
+			return 0, "", fmt.Errorf("curl is not installed on the remote host")
+		}
+		return 0, "", commandError("curl", result, err)
+	}
+
+	body, code := "", result.Stdout
+	if i := strings.LastIndex(result.Stdout, "\n"); i >= 0 {
+		body, code = result.Stdout[:i], result.Stdout[i+1:]
+	}
+	status, err := strconv.Atoi(strings.TrimSpace(code))
+	if err != nil {
+		return 0, "", fmt.Errorf("unexpected curl output: no status code")
+	}
+	if len(body) > maxSmokeBody {
+		body = body[:maxSmokeBody]
+	}
+	return status, body, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSmokeChecks(t *testing.T) {
+	checks, err := parseSmokeChecks(`https://example.com/health
+# comment
+runner https://example.com/ 301
+remote http://localhost:8080/ready 200 {"status": "ok"}
+remote http://localhost:8080/version "v1 2"`)
+	if err != nil {
+		t.Fatalf("parseSmokeChecks() returned unexpected error: %v", err)
+	}
+	want := []SmokeCheck{
+		{URL: "https://example.com/health", Status: 200},
+		{URL: "https://example.com/", Status: 301},
+		{URL: "http://localhost:8080/ready", Remote: true, Status: 200, Body: `{"status": "ok"}`},
+		{URL: "http://localhost:8080/version", Remote: true, Status: 200, Body: "v1 2"},
+	}
+	if len(checks) != len(want) {
+		t.Fatalf("parseSmokeChecks() = %+v, want %+v", checks, want)
+	}
+	for i := range want {
+		if checks[i] != want[i] {
+			t.Errorf("check %d = %#v, want %#v", i, checks[i], want[i])
+		}
+	}
+
+	for _, line := range []string{"remote", "ftp://example.com", "localhost:8080/health", "https://example.com 600"} {
+		if _, err := parseSmokeChecks(line); err == nil {
+			t.Errorf("parseSmokeChecks(%q) should return error", line)
+		}
+	}
+}
+
+func TestRunSmokeChecks(t *testing.T) {
+	smokeRetryDelay = time.Millisecond
+	t.Cleanup(func() { smokeRetryDelay = 5 * time.Second })
+
+	// The runner endpoint comes up on the third request
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, `{"status":"ok"}`)
+	}))
+	defer server.Close()
+
+	var remoteCommands []string
+	client := &SSHClient{
+		RunCommand: func(ctx context.Context, cmd string) (*CommandResult, error) {
+			remoteCommands = append(remoteCommands, cmd)
+			if strings.Contains(cmd, "/missing") {
+				return &CommandResult{Stdout: "not found\n404"}, nil
+			}
+			return &CommandResult{Stdout: "pong\n200"}, nil
+		},
+	}
+	d := &Deployment{Inputs: &Inputs{RemoteDir: "."}, Client: client}
+
+	checks := []SmokeCheck{
+		{URL: server.URL, Status: 200, Body: `"ok"`},
+		{URL: "http://localhost:8080/ping", Remote: true, Status: 200, Body: "pong"},
+	}
+	if err := d.runSmokeChecks(context.Background(), checks, 3, time.Second); err != nil {
+		t.Errorf("runSmokeChecks() returned unexpected error: %v", err)
+	}
+
+	// Redirects are not followed, as with curl on the remote host
+	redirect := httptest.NewServer(http.RedirectHandler(server.URL, http.StatusMovedPermanently))
+	defer redirect.Close()
+	if status, _, err := runnerRequest(context.Background(), redirect.URL, time.Second); err != nil || status != http.StatusMovedPermanently {
+		t.Errorf("runnerRequest() of a redirect = %d, %v, want 301", status, err)
+	}
+	if requests != 3 {
+		t.Errorf("runner endpoint requested %d times, want 3", requests)
+	}
+	if want := "curl -sS --max-time 1 -w '\\n%{http_code}' 'http://localhost:8080/ping'"; len(remoteCommands) != 1 || remoteCommands[0] != want {
+		t.Errorf("remote commands = %q, want %q", remoteCommands, want)
+	}
+
+	// Failing checks are retried, then reported together
+	checks = []SmokeCheck{
+		{URL: "http://localhost:8080/missing", Remote: true, Status: 200},
+		{URL: "http://localhost:8080/ping", Remote: true, Status: 200, Body: "ok"},
+	}
+	remoteCommands = nil
+	err := d.runSmokeChecks(context.Background(), checks, 1, time.Second)
+	if err == nil || err.Error() != "2 of 2 smoke checks failed" {
+		t.Errorf("runSmokeChecks() error = %v, want both checks to fail", err)
+	}
+	if len(remoteCommands) != 4 {
+		t.Errorf("ran %d remote requests, want 2 attempts per check", len(remoteCommands))
+	}
+}
@@ -1,88 +1,231 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 // CommandRunner defines the interface for running commands
-type CommandRunner func(cmd string) (string, error)
+type CommandRunner func(ctx context.Context, cmd string) (*CommandResult, error)
 
 // SSHClient handles SSH connections and operations
 type SSHClient struct {
 	client     *ssh.Client
+	jumps      []*ssh.Client // jump host connections the client is tunneled through
+	identity   string
+	done       chan struct{}
+	closeOnce  sync.Once
 	RunCommand CommandRunner
+	// StreamCommand runs a command like RunCommand while echoing its output
+	// to the job log as it is produced
+	StreamCommand CommandRunner
+	logOutput     io.Writer
+	// CommandTimeout bounds every remote command, 0 disables the limit
+	CommandTimeout time.Duration
+
+	// TransferMethod selects the file transfer backend: TransferAuto,
+	// TransferSFTP or TransferSCP
+	TransferMethod string
+	// SCPPath is the scp binary run on the remote host for scp transfers
+	SCPPath string
+
+	sftp       *sftp.Client
+	sftpFailed bool
 }
 
-// CreateSSHClient creates a new SSH client with the given credentials
-func CreateSSHClient(user, key, host string, port int) (*SSHClient, error) {
-	signer, err := ssh.ParsePrivateKey([]byte(key))
+// SSHConfig holds the settings used to connect to a remote host
+type SSHConfig struct {
+	User string
+	Key  string
+	Host string
+	Port int
+
+	// KeyPassphrase decrypts Key when it is encrypted
+	KeyPassphrase string
+	// Certificate is an OpenSSH user certificate for Key, signed by a CA
+	Certificate string
+
+	// KnownHosts is known_hosts content or a path to a known_hosts file
+	KnownHosts string
+	// HostFingerprint pins one or more SHA256 host key fingerprints
+	HostFingerprint string
+	// HostCA lists CA public keys trusted to sign host certificates
+	HostCA string
+
+	// JumpHosts are dialed in order and the connection to Host is tunneled
+	// through the last of them (like OpenSSH ProxyJump)
+	JumpHosts []SSHConfig
+
+	// ConnectTimeout bounds the TCP connect and SSH handshake of each hop
+	ConnectTimeout time.Duration
+	// Retries is the number of extra connection attempts on transient errors
+	Retries int
+	// KeepaliveInterval is how often keepalive requests are sent, 0 disables them
+	KeepaliveInterval time.Duration
+}
+
+// Addr returns the host:port address to dial
+func (c SSHConfig) Addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// CreateSSHClient creates a new SSH client with the given credentials.
+// Cancelling ctx aborts connection attempts and retries.
+func CreateSSHClient(ctx context.Context, cfg SSHConfig) (*SSHClient, error) {
+	key, config, err := clientConfig(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse private key: %v", err)
+		return nil, err
 	}
 
-	config := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	// Prepare every hop before dialing so configuration errors surface
+	// without opening any connection
+	hops := make([]SSHConfig, len(cfg.JumpHosts))
+	hopConfigs := make([]*ssh.ClientConfig, len(cfg.JumpHosts))
+	for i, jump := range cfg.JumpHosts {
+		hops[i] = jump.inherit(cfg)
+		if _, hopConfigs[i], err = clientConfig(hops[i]); err != nil {
+			return nil, fmt.Errorf("jump host %s: %v", hops[i].Addr(), err)
+		}
 	}
 
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", host, port), config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to dial: %v", err)
+	// Dial the whole chain again on transient network errors. Auth and host
+	// key failures are returned immediately.
+	var client *ssh.Client
+	var jumps []*ssh.Client
+	attempts := cfg.Retries + 1
+	for attempt := 1; ; attempt++ {
+		client, jumps, err = dialChain(ctx, hops, hopConfigs, cfg, config)
+		if err == nil {
+			break
+		}
+		if attempt >= attempts || !isTransientError(err) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		delay := retryDelay(attempt)
+		logWarning(fmt.Sprintf("Connection attempt %d/%d failed: %v; retrying in %s",
+			attempt, attempts, err, delay.Round(time.Millisecond)))
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to dial: %w", ctx.Err())
+		case <-time.After(delay):
+		}
 	}
 
-	sshClient := &SSHClient{client: client}
-	sshClient.RunCommand = sshClient.runCommand // Set default implementation
+	sshClient := newSSHClient(client)
+	sshClient.jumps = jumps
+	sshClient.identity = key.String()
+	if cfg.KeepaliveInterval > 0 {
+		go sshClient.keepalive(cfg.KeepaliveInterval)
+	}
 	return sshClient, nil
 }
 
-// runCommand executes a command on the remote server (internal implementation)
-func (s *SSHClient) runCommand(cmd string) (string, error) {
-	if s.client == nil {
-		return "", fmt.Errorf("SSH client is nil")
+// clientConfig parses the key and host key settings of a single hop
+func clientConfig(cfg SSHConfig) (*PrivateKey, *ssh.ClientConfig, error) {
+	key, err := ParsePrivateKey(cfg.Key, cfg.KeyPassphrase)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	session, err := s.client.NewSession()
+	verifier, err := NewHostKeyVerifier(cfg.KnownHosts, cfg.HostFingerprint, cfg.HostCA)
 	if err != nil {
-		return "", fmt.Errorf("failed to create session: %v", err)
+		return nil, nil, err
 	}
-	defer session.Close()
 
-	output, err := session.CombinedOutput(cmd)
-	if err != nil {
-		return "", fmt.Errorf("failed to run command: %v", err)
+	signers := []ssh.Signer{key.Signer}
+	if strings.TrimSpace(cfg.Certificate) != "" {
+		cert, err := ParseCertificate(cfg.Certificate)
+		if err != nil {
+			return nil, nil, err
+		}
+		certSigner, err := NewCertificateSigner(cert, key.Signer, cfg.User)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Offer the certificate first, the plain key remains as fallback
+		signers = []ssh.Signer{certSigner, key.Signer}
+	}
+
+	config := &ssh.ClientConfig{
+		User: cfg.User,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signers...),
+		},
+		HostKeyCallback:   verifier.Callback(),
+		HostKeyAlgorithms: verifier.HostKeyAlgorithms(cfg.Addr()),
 	}
+	return key, config, nil
+}
+
+// inherit fills the unset fields of a jump host from the target host config.
+// Host key settings are only inherited when the jump host sets neither.
+func (c SSHConfig) inherit(target SSHConfig) SSHConfig {
+	if c.User == "" {
+		c.User = target.User
+	}
+	if c.Port == 0 {
+		c.Port = 22
+	}
+	if c.Key == "" {
+		c.Key = target.Key
+		c.KeyPassphrase = target.KeyPassphrase
+		c.Certificate = target.Certificate
+	}
+	if c.KnownHosts == "" && c.HostFingerprint == "" && c.HostCA == "" {
+		c.KnownHosts = target.KnownHosts
+		c.HostCA = target.HostCA
+	}
+	c.JumpHosts = nil
+	c.ConnectTimeout = target.ConnectTimeout
+	return c
+}
 
-	return string(output), nil
+// newSSHClient wraps an established connection with the default command runner
+func newSSHClient(client *ssh.Client) *SSHClient {
+	sshClient := &SSHClient{client: client, done: make(chan struct{}), logOutput: os.Stdout}
+	sshClient.RunCommand = sshClient.runCommand // Set default implementation
+	sshClient.StreamCommand = sshClient.streamCommand
+	return sshClient
+}
+
+// shellQuote quotes s for safe use as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runCommand executes a command on the remote server (internal implementation)
+func (s *SSHClient) runCommand(ctx context.Context, cmd string) (*CommandResult, error) {
+	return s.execute(ctx, cmd, nil, nil)
 }
 
-// TransferFile copies a local file to the remote server using SCP
+// TransferFile copies a local file to the remote server
 // The remote path will be the base name of the local file
-func (s *SSHClient) TransferFile(localPath string) error {
-	return s.TransferFileWithRemotePath(localPath, filepath.Base(localPath))
+func (s *SSHClient) TransferFile(ctx context.Context, localPath string) error {
+	return s.TransferFileWithRemotePath(ctx, localPath, filepath.Base(localPath))
 }
 
-// TransferFileWithRemotePath copies a local file to the remote server using SCP
-// with a specified remote path
-func (s *SSHClient) TransferFileWithRemotePath(localPath, remotePath string) error {
+// TransferFileWithRemotePath copies a local file to the remote server with a
+// specified remote path, creating missing remote directories. The local file
+// mode is preserved and an existing remote file is replaced atomically.
+// Cancelling ctx aborts the transfer and leaves the remote file unchanged.
+func (s *SSHClient) TransferFileWithRemotePath(ctx context.Context, localPath, remotePath string) error {
 	if s.client == nil {
 		return fmt.Errorf("SSH client is nil")
 	}
 
-	// Create a new session for file transfer
-	session, err := s.client.NewSession()
-	if err != nil {
-		return fmt.Errorf("failed to create session: %v", err)
-	}
-	defer session.Close()
-
 	// Open local file
 	f, err := os.Open(localPath)
 	if err != nil {
@@ -90,33 +233,53 @@ func (s *SSHClient) TransferFileWithRemotePath(localPath, remotePath string) err
 	}
 	defer f.Close()
 
-	// Get file info for size
+	// Get file info for size and mode
 	fi, err := f.Stat()
 	if err != nil {
 		return fmt.Errorf("failed to stat file: %v", err)
 	}
 
-	// Start scp on the remote side
-	go func() {
-		w, _ := session.StdinPipe()
-		defer w.Close()
-		fmt.Fprintf(w, "C0644 %d %s\n", fi.Size(), remotePath)
-		io.Copy(w, f)
-		fmt.Fprint(w, "\x00")
-	}()
+	if err := s.upload(ctx, f, fi.Size(), remotePath, fi.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to transfer %s to %s: %w", localPath, remotePath, err)
+	}
+	return nil
+}
 
-	// Run scp command to receive file
-	if err := session.Run("/usr/bin/scp -t ."); err != nil {
-		return fmt.Errorf("failed to transfer file: %v", err)
+// TransferReader streams size bytes from r to remotePath with the given mode,
+// with the same atomic replacement as TransferFileWithRemotePath. Nothing is
+// written to the local filesystem.
+func (s *SSHClient) TransferReader(ctx context.Context, r io.Reader, size int64, remotePath string, mode os.FileMode) error {
+	if s.client == nil {
+		return fmt.Errorf("SSH client is nil")
 	}
 
+	if err := s.upload(ctx, r, size, remotePath, mode); err != nil {
+		return fmt.Errorf("failed to transfer to %s: %w", remotePath, err)
+	}
 	return nil
 }
 
-// Close closes the SSH client connection
+// TransferBytes uploads data from memory to remotePath with the given mode
+func (s *SSHClient) TransferBytes(ctx context.Context, data []byte, remotePath string, mode os.FileMode) error {
+	return s.TransferReader(ctx, bytes.NewReader(data), int64(len(data)), remotePath, mode)
+}
+
+// Close closes the SSH client connection and any jump host connections
 func (s *SSHClient) Close() error {
-	if s.client != nil {
-		return s.client.Close()
-	}
-	return nil
+	var err error
+	s.closeOnce.Do(func() {
+		if s.done != nil {
+			close(s.done)
+		}
+		if s.sftp != nil {
+			s.sftp.Close()
+		}
+		if s.client != nil {
+			err = s.client.Close()
+		}
+		for i := len(s.jumps) - 1; i >= 0; i-- {
+			s.jumps[i].Close()
+		}
+	})
+	return err
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSSHClientCreation(t *testing.T) {
@@ -68,7 +71,13 @@ malformed
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			client, err := CreateSSHClient(tt.user, tt.key, tt.host, tt.port)
+			client, err := CreateSSHClient(context.Background(), SSHConfig{
+				User:            tt.user,
+				Key:             tt.key,
+				Host:            tt.host,
+				Port:            tt.port,
+				HostFingerprint: "SHA256:nBeqeaxfp9yYlU+UBqhaFDj2D/sTSlpUTjw3eaJ1VUM",
+			})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CreateSSHClient() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -83,10 +92,10 @@ malformed
 
 func TestSSHClientMethods(t *testing.T) {
 	// Test with nil client
-	client := &SSHClient{client: nil}
+	client := newSSHClient(nil)
 
 	// Test RunCommand with nil client
-	if _, err := client.RunCommand("test"); err == nil {
+	if _, err := client.RunCommand(context.Background(), "test"); err == nil {
 		t.Error("RunCommand() with nil client should return error")
 	}
 
@@ -106,8 +115,8 @@ func TestSSHClientTransferFile(t *testing.T) {
 	}
 
 	// Test with nil client
-	client := &SSHClient{client: nil}
-	if err := client.TransferFile(tmpFile); err == nil {
+	client := newSSHClient(nil)
+	if err := client.TransferFile(context.Background(), tmpFile); err == nil {
 		t.Error("TransferFile() with nil client should return error")
 	}
 
@@ -117,7 +126,13 @@ b3BlbnNzaC1rZXktdjEAAAAABG5vbmUAAAAEbm9uZQAAAAAAAAABAAABFwAAAAdzc2gtcn
 NhAAAAAwEAAQAAAQEAvRQk2oQqLB01iCnJuv0J6qEgMrLFPYChZZmykYgNQcxxjBVqFHn6
 -----END OPENSSH PRIVATE KEY-----`
 
-	client, err := CreateSSHClient("testuser", validKey, "nonexistent.host", 22)
+	client, err := CreateSSHClient(context.Background(), SSHConfig{
+		User:            "testuser",
+		Key:             validKey,
+		Host:            "nonexistent.host",
+		Port:            22,
+		HostFingerprint: "SHA256:nBeqeaxfp9yYlU+UBqhaFDj2D/sTSlpUTjw3eaJ1VUM",
+	})
 	if err == nil {
 		t.Error("Expected error for nonexistent host")
 		if err := client.Close(); err != nil {
@@ -127,7 +142,7 @@ NhAAAAAwEAAQAAAQEAvRQk2oQqLB01iCnJuv0J6qEgMrLFPYChZZmykYgNQcxxjBVqFHn6
 
 	// Test with invalid file path
 	if client != nil {
-		if err := client.TransferFile("/nonexistent/file"); err == nil {
+		if err := client.TransferFile(context.Background(), "/nonexistent/file"); err == nil {
 			t.Error("Expected error for nonexistent file")
 		}
 	}
@@ -142,38 +157,157 @@ func TestValidateFiles(t *testing.T) {
 		t.Fatalf("failed to create test file: %v", err)
 	}
 
+	testDigest, err := localSHA256(tmpFile)
+	if err != nil {
+		t.Fatalf("localSHA256() returned unexpected error: %v", err)
+	}
+	envDigest := strings.Repeat("a", 64)
+	files := []fileDigest{
+		{RemotePath: ".env", SHA256: envDigest},
+		{RemotePath: "test.txt", SHA256: testDigest},
+	}
+
 	// Test with nil client
-	client := &SSHClient{client: nil}
-	if err := validateFiles(client, ".env", "test.txt"); err == nil {
+	client := newSSHClient(nil)
+	if err := validateFiles(context.Background(), client, files...); err == nil {
 		t.Error("validateFiles() with nil client should return error")
 	}
 
 	// Test with mock client that simulates missing files
 	mockClient := &SSHClient{
 		client: nil,
-		RunCommand: func(cmd string) (string, error) {
-			// Simulate ls output with only one file
-			return "-rw-r--r-- 1 user group 123 Mar 21 17:38 .env", nil
+		RunCommand: func(ctx context.Context, cmd string) (*CommandResult, error) {
+			// Simulate checksum output with only one file present
+			return &CommandResult{Stdout: envDigest + "  -\nmissing\n"}, nil
 		},
 	}
 
-	if err := validateFiles(mockClient, ".env", "test.txt"); err == nil {
+	if err := validateFiles(context.Background(), mockClient, files...); err == nil {
 		t.Error("validateFiles() should return error when file is missing")
 	} else if !strings.Contains(err.Error(), "test.txt") {
 		t.Errorf("validateFiles() error should mention missing file, got: %v", err)
 	}
 
+	// Test with mock client that simulates a truncated upload
+	mockClient = &SSHClient{
+		client: nil,
+		RunCommand: func(ctx context.Context, cmd string) (*CommandResult, error) {
+			return &CommandResult{Stdout: envDigest + "  -\n" + strings.Repeat("b", 64) + "  -\n"}, nil
+		},
+	}
+
+	if err := validateFiles(context.Background(), mockClient, files...); err == nil {
+		t.Error("validateFiles() should return error on checksum mismatch")
+	} else if !strings.Contains(err.Error(), "test.txt: expected sha256 "+testDigest) || strings.Contains(err.Error(), ".env:") {
+		t.Errorf("validateFiles() error should report only the mismatched file, got: %v", err)
+	}
+
 	// Test with mock client that simulates all files present
 	mockClient = &SSHClient{
 		client: nil,
-		RunCommand: func(cmd string) (string, error) {
-			// Simulate ls output with both files
-			return `-rw-r--r-- 1 user group 123 Mar 21 17:38 .env
--rw-r--r-- 1 user group 456 Mar 21 17:38 test.txt`, nil
+		RunCommand: func(ctx context.Context, cmd string) (*CommandResult, error) {
+			// Simulate checksum output for both files
+			return &CommandResult{Stdout: envDigest + "  -\n" + testDigest + "  -\n"}, nil
+		},
+	}
+
+	if err := validateFiles(context.Background(), mockClient, files...); err != nil {
+		t.Errorf("validateFiles() returned unexpected error: %v", err)
+	}
+}
+
+func TestCommandResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		result     *CommandResult
+		err        error
+		wantStatus string
+		wantErr    []string
+	}{
+		{
+			name: "exit_code",
+			result: &CommandResult{
+				Stdout:   "Pulling web ...\n",
+				Stderr:   "Pulling web ... error\nmanifest for web:abc1234 not found\n",
+				ExitCode: 18,
+				Duration: 1500 * time.Millisecond,
+			},
+			err:        errors.New("failed to run command: Process exited with status 18"),
+			wantStatus: "exit code 18",
+			wantErr:    []string{"docker compose pull: exit code 18 after 1.5s", "\n  manifest for web:abc1234 not found"},
+		},
+		{
+			name: "signal",
+			result: &CommandResult{
+				ExitCode: 143,
+				Signal:   "TERM",
+				Duration: time.Minute,
+			},
+			err:        errors.New("failed to run command: Process exited with status 143 from signal TERM"),
+			wantStatus: "killed by signal TERM",
+			wantErr:    []string{"killed by signal TERM after 1m0s"},
 		},
+		{
+			name:       "connection_lost",
+			result:     &CommandResult{ExitCode: -1},
+			err:        errors.New("failed to run command: wait: remote command exited without exit status or exit signal"),
+			wantStatus: "no exit status",
+			wantErr:    []string{"exited without exit status"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &SSHClient{
+				RunCommand: func(ctx context.Context, cmd string) (*CommandResult, error) {
+					return tt.result, tt.err
+				},
+			}
+			result, err := client.RunCommand(context.Background(), "docker compose pull")
+			if result.Status() != tt.wantStatus {
+				t.Errorf("Status() = %q, want %q", result.Status(), tt.wantStatus)
+			}
+			got := commandError("docker compose pull", result, err).Error()
+			for _, want := range tt.wantErr {
+				if !strings.Contains(got, want) {
+					t.Errorf("commandError() = %q, want it to contain %q", got, want)
+				}
+			}
+		})
 	}
+}
+
+func TestStderrTail(t *testing.T) {
+	result := &CommandResult{Stderr: "one\n\ntwo\r\nthree\nfour\n"}
+	if got := result.StderrTail(3); strings.Join(got, ",") != "two,three,four" {
+		t.Errorf("StderrTail(3) = %q", got)
+	}
+	if got := result.StderrTail(10); len(got) != 4 {
+		t.Errorf("StderrTail(10) = %q, want all non-empty lines", got)
+	}
+}
+
+func TestValidateFilesRemote(t *testing.T) {
+	_, client := newTestClient(t)
 
-	if err := validateFiles(mockClient, ".env", "test.txt"); err != nil {
+	// "app.yml" is a substring of "my-app.yml" but must not satisfy validation
+	localFile := filepath.Join(t.TempDir(), "app.yml")
+	if err := os.WriteFile(localFile, []byte("services: {}\n"), 0644); err != nil {
+		t.Fatalf("failed to write local file: %v", err)
+	}
+	if err := client.TransferFileWithRemotePath(context.Background(), localFile, "my-app.yml"); err != nil {
+		t.Fatalf("TransferFileWithRemotePath() returned unexpected error: %v", err)
+	}
+	digest, err := localSHA256(localFile)
+	if err != nil {
+		t.Fatalf("localSHA256() returned unexpected error: %v", err)
+	}
+
+	if err := validateFiles(context.Background(), client, fileDigest{RemotePath: "my-app.yml", SHA256: digest}); err != nil {
 		t.Errorf("validateFiles() returned unexpected error: %v", err)
 	}
+	err = validateFiles(context.Background(), client, fileDigest{RemotePath: "app.yml", SHA256: digest})
+	if err == nil || !strings.Contains(err.Error(), "app.yml: not found") {
+		t.Errorf("validateFiles() should report app.yml as missing, got: %v", err)
+	}
 }
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is a minimal in-process SSH server for tests. Exec requests
+// run through `sh -c` in Dir, and direct-tcpip channels are forwarded so the
+// server can act as a jump host.
+type testSSHServer struct {
+	Addr    string
+	Dir     string
+	HostKey ssh.PublicKey
+	// DisableSFTP rejects the sftp subsystem, like hosts without sftp-server
+	DisableSFTP bool
+
+	listener   net.Listener
+	hostSigner ssh.Signer
+	wg         sync.WaitGroup
+
+	// mu guards config, which AddHostCertificate changes while serving
+	mu     sync.Mutex
+	config *ssh.ServerConfig
+}
+
+// newTestSSHServer starts a server accepting any client key for user "deploy"
+func newTestSSHServer(t testing.TB) *testSSHServer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("failed to create host signer: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != "deploy" {
+				return nil, errors.New("unknown user")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	s := &testSSHServer{
+		Addr:       listener.Addr().String(),
+		Dir:        t.TempDir(),
+		HostKey:    hostSigner.PublicKey(),
+		listener:   listener,
+		config:     config,
+		hostSigner: hostSigner,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Port returns the port the server listens on
+func (s *testSSHServer) Port() int {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// KnownHosts returns a known_hosts line for the server
+func (s *testSSHServer) KnownHosts() string {
+	return knownhosts.Line([]string{s.Addr}, s.HostKey)
+}
+
+// AddHostCertificate makes the server offer a certificate for its host key
+func (s *testSSHServer) AddHostCertificate(t testing.TB, cert *ssh.Certificate) {
+	signer, err := ssh.NewCertSigner(cert, s.hostSigner)
+	if err != nil {
+		t.Fatalf("failed to create host certificate signer: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.AddHostKey(signer)
+}
+
+// Close stops accepting connections
+func (s *testSSHServer) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *testSSHServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *testSSHServer) handleConn(conn net.Conn) {
+	s.mu.Lock()
+	config := *s.config
+	s.mu.Unlock()
+	_, chans, reqs, err := ssh.NewServerConn(conn, &config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		switch newChan.ChannelType() {
+		case "session":
+			go s.handleSession(newChan)
+		case "direct-tcpip":
+			go s.handleDirectTCPIP(newChan)
+		default:
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func (s *testSSHServer) handleSession(newChan ssh.NewChannel) {
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	// Requests keep being read while a command runs, so "signal" requests
+	// reach the process like they do with sshd
+	var cmd *exec.Cmd
+	defer func() {
+		if cmd != nil {
+			cmd.Process.Kill()
+		}
+	}()
+
+	for req := range reqs {
+		switch {
+		case req.Type == "subsystem" && !s.DisableSFTP:
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(ch, sftp.WithServerWorkingDirectory(s.Dir))
+			if err != nil {
+				return
+			}
+			server.Serve()
+			return
+
+		case req.Type == "signal" && cmd != nil:
+			var payload struct{ Signal string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				continue
+			}
+			for sig, name := range signalNames {
+				if name == payload.Signal {
+					cmd.Process.Signal(sig)
+				}
+			}
+
+		case req.Type == "exec" && cmd == nil:
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				return
+			}
+
+			cmd = exec.Command("sh", "-c", payload.Command)
+			cmd.Dir = s.Dir
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+
+			// Like sshd, don't wait for the client to close stdin once the
+			// process has exited
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				req.Reply(false, nil)
+				return
+			}
+			if err := cmd.Start(); err != nil {
+				req.Reply(false, nil)
+				return
+			}
+			req.Reply(true, nil)
+			go func() {
+				io.Copy(stdin, ch)
+				stdin.Close()
+			}()
+			go s.waitCommand(ch, cmd)
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// waitCommand reports the exit status or signal of cmd and closes ch
+func (s *testSSHServer) waitCommand(ch ssh.Channel, cmd *exec.Cmd) {
+	defer ch.Close()
+
+	status := 0
+	if err := cmd.Wait(); err != nil {
+		status = 255
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			status = exitErr.ExitCode()
+			// Report processes killed by a signal like sshd does
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+					Signal     string
+					CoreDumped bool
+					Msg        string
+					Lang       string
+				}{Signal: signalNames[ws.Signal()]}))
+				return
+			}
+		}
+	}
+
+	code := make([]byte, 4)
+	binary.BigEndian.PutUint32(code, uint32(status))
+	ch.SendRequest("exit-status", false, code)
+}
+
+// signalNames maps signals to their SSH protocol names
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGTERM: "TERM",
+}
+
+func (s *testSSHServer) handleDirectTCPIP(newChan ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChan.ExtraData(), &target); err != nil {
+		newChan.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	io.Copy(conn, ch)
+	conn.Close()
+	ch.Close()
+}
+
+// newTestClientKey returns an unencrypted OpenSSH private key
+func newTestClientKey(t testing.TB) string {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate client key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatalf("failed to marshal client key: %v", err)
+	}
+	return string(pem.EncodeToMemory(block))
+}
+
+// testSSHConfig returns a client config for connecting to the server
+func (s *testSSHServer) testSSHConfig(t testing.TB) SSHConfig {
+	return SSHConfig{
+		User:       "deploy",
+		Key:        newTestClientKey(t),
+		Host:       "127.0.0.1",
+		Port:       s.Port(),
+		KnownHosts: s.KnownHosts(),
+	}
+}
+
+// connect returns a client connected to the server, closed when the test ends
+func (s *testSSHServer) connect(t testing.TB) *SSHClient {
+	t.Helper()
+	client, err := CreateSSHClient(context.Background(), s.testSSHConfig(t))
+	if err != nil {
+		t.Fatalf("CreateSSHClient() returned unexpected error: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newTestClient starts a test server and connects a client to it
+func newTestClient(t testing.TB) (*testSSHServer, *SSHClient) {
+	t.Helper()
+	server := newTestSSHServer(t)
+	return server, server.connect(t)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// lineWriter forwards complete lines to out as they arrive. Writers created
+// for the stdout and stderr of one command share mu, so lines from both
+// streams are never interleaved mid-line.
+type lineWriter struct {
+	mu  *sync.Mutex
+	out io.Writer
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.writeLine(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes a trailing line that has no newline
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) writeLine(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintf(w.out, "%s\n", bytes.TrimSuffix(line, []byte("\r")))
+}
+
+// streamCommand runs a command on the remote server, echoing its output to
+// the job log line by line while it runs. Workflow commands are disabled
+// while streaming so remote output cannot inject ::set-output:: and the like.
+func (s *SSHClient) streamCommand(ctx context.Context, cmd string) (*CommandResult, error) {
+	var mu sync.Mutex
+	stdout := &lineWriter{mu: &mu, out: s.logOutput}
+	stderr := &lineWriter{mu: &mu, out: s.logOutput}
+
+	token := randomSuffix()
+	fmt.Fprintf(s.logOutput, "::stop-commands::%s\n", token)
+	result, err := s.execute(ctx, cmd, stdout, stderr)
+	stdout.Flush()
+	stderr.Flush()
+	fmt.Fprintf(s.logOutput, "::%s::\n", token)
+	return result, err
+}
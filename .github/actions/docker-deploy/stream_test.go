@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &lineWriter{mu: &sync.Mutex{}, out: &out}
+
+	w.Write([]byte("Pulling web"))
+	if out.Len() != 0 {
+		t.Fatalf("partial line written early: %q", out.String())
+	}
+	w.Write([]byte(" ... done\r\nPulling api\nPulling "))
+	w.Write([]byte("redis"))
+	w.Flush()
+
+	want := "Pulling web ... done\nPulling api\nPulling redis\n"
+	if out.String() != want {
+		t.Errorf("lineWriter output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestStreamCommand(t *testing.T) {
+	_, client := newTestClient(t)
+
+	var log bytes.Buffer
+	client.logOutput = &log
+
+	result, err := client.StreamCommand(context.Background(), "echo pulling; echo '::set-output name=x::y'; echo 'no such image' >&2; exit 3")
+	if err == nil {
+		t.Fatal("expected error for failing command")
+	}
+	output := result.Output()
+	for _, line := range []string{"pulling", "::set-output name=x::y", "no such image"} {
+		if !strings.Contains(output, line) {
+			t.Errorf("output of failed command should contain %q, got %q", line, output)
+		}
+		if !strings.Contains(log.String(), line+"\n") {
+			t.Errorf("log should contain %q, got %q", line, log.String())
+		}
+	}
+
+	// Workflow commands are disabled around the streamed output
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	token := strings.TrimPrefix(lines[0], "::stop-commands::")
+	if token == lines[0] || lines[len(lines)-1] != "::"+token+"::" {
+		t.Errorf("streamed output should be wrapped in stop-commands, got %q", log.String())
+	}
+
+	// RunCommand keeps the output of failed commands as well
+	result, err = client.RunCommand(context.Background(), "echo partial; exit 1")
+	if err == nil || result.Stdout != "partial\n" {
+		t.Errorf("RunCommand() = %q, %v; want output of failed command", result.Stdout, err)
+	}
+}
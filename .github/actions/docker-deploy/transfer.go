@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// File transfer backends
+const (
+	TransferAuto = "auto" // SFTP, falling back to scp when the subsystem is unavailable
+	TransferSFTP = "sftp"
+	TransferSCP  = "scp"
+)
+
+// defaultSCPPath is looked up in the remote PATH
+const defaultSCPPath = "scp"
+
+// cleanupTimeout bounds the removal of temporary files, which also runs
+// after the deploy context was cancelled
+const cleanupTimeout = 30 * time.Second
+
+// TransferredFile describes a file copied to the remote host
+type TransferredFile struct {
+	LocalPath  string
+	RemotePath string
+	Size       int64
+	Mode       os.FileMode
+}
+
+// TransferDir recursively copies localDir to remoteDir, keeping the relative
+// paths and modes of all regular files. Symlinks to files are followed; other
+// special files are skipped.
+func (s *SSHClient) TransferDir(ctx context.Context, localDir, remoteDir string) ([]TransferredFile, error) {
+	var files []TransferredFile
+	err := filepath.WalkDir(localDir, func(localPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		fi, err := os.Stat(localPath)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %v", localPath, err)
+		}
+		if !fi.Mode().IsRegular() {
+			logWarning(fmt.Sprintf("Skipping %s: not a regular file", localPath))
+			return nil
+		}
+
+		rel, err := filepath.Rel(localDir, localPath)
+		if err != nil {
+			return err
+		}
+		remotePath := path.Join(remoteDir, filepath.ToSlash(rel))
+		if err := s.TransferFileWithRemotePath(ctx, localPath, remotePath); err != nil {
+			return err
+		}
+
+		files = append(files, TransferredFile{
+			LocalPath:  localPath,
+			RemotePath: remotePath,
+			Size:       fi.Size(),
+			Mode:       fi.Mode().Perm(),
+		})
+		return nil
+	})
+	if err != nil {
+		return files, fmt.Errorf("failed to transfer directory %s: %v", localDir, err)
+	}
+	return files, nil
+}
+
+// upload atomically replaces remotePath with size bytes from r. The data is
+// written to a temporary file in the same directory, verified by size and
+// SHA-256, and only then renamed over remotePath, so the remote file is
+// always either the old or the new complete version.
+func (s *SSHClient) upload(ctx context.Context, r io.Reader, size int64, remotePath string, mode os.FileMode) error {
+	dir, name := path.Split(remotePath)
+	if name == "" {
+		return fmt.Errorf("invalid remote path %q", remotePath)
+	}
+	tmpPath := dir + "." + name + ".tmp-" + randomSuffix()
+
+	h := sha256.New()
+	if err := s.uploadTo(ctx, io.TeeReader(&contextReader{ctx: ctx, r: r}, h), size, tmpPath, mode); err != nil {
+		s.removeRemote(tmpPath)
+		if ctx.Err() != nil {
+			return fmt.Errorf("transfer interrupted: %w", ctx.Err())
+		}
+		return err
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	result, err := s.runCommand(ctx, replaceCommand(tmpPath, remotePath, size, digest))
+	if err != nil {
+		s.removeRemote(tmpPath)
+		return fmt.Errorf("failed to replace %s: %v", remotePath, err)
+	}
+	if status := strings.TrimSpace(result.Output()); status != "ok" {
+		s.removeRemote(tmpPath)
+		return fmt.Errorf("upload verification failed, %s left unchanged: %s", remotePath, status)
+	}
+	return nil
+}
+
+// replaceCommand verifies the size and SHA-256 of the uploaded temporary
+// file and renames it into place. It prints "ok" or the reason it gave up.
+func replaceCommand(tmpPath, target string, size int64, digest string) string {
+	return fmt.Sprintf("f=%s; t=%s; ", shellQuote(tmpPath), shellQuote(target)) +
+		selectSumCommand +
+		`if [ ! -f "$f" ]; then echo "temporary file missing"; exit 0; fi; ` +
+		`if [ -d "$t" ]; then echo "$t is a directory"; exit 0; fi; ` +
+		`size=$(wc -c < "$f" | tr -d ' '); digest=$($sum < "$f" | cut -d' ' -f1); ` +
+		fmt.Sprintf(`if [ "$size" != "%d" ] || [ "$digest" != "%s" ]; then `, size, digest) +
+		fmt.Sprintf(`echo "expected %d bytes with sha256 %s, got $size bytes with sha256 $digest"; exit 0; fi; `, size, digest) +
+		`mv -f "$f" "$t" && echo ok || echo "rename failed"`
+}
+
+// removeRemote deletes a leftover temporary file, ignoring errors
+func (s *SSHClient) removeRemote(remotePath string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	s.runCommand(ctx, "rm -f "+shellQuote(remotePath))
+}
+
+// contextReader fails reads once ctx is cancelled, stopping a transfer
+// between chunks
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func randomSuffix() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// uploadTo copies size bytes from r to remotePath with the given mode using
+// the configured transfer backend
+func (s *SSHClient) uploadTo(ctx context.Context, r io.Reader, size int64, remotePath string, mode os.FileMode) error {
+	switch s.TransferMethod {
+	case TransferSCP:
+		return s.scpUpload(ctx, r, size, remotePath, mode)
+	case TransferSFTP:
+		c, err := s.sftpClient()
+		if err != nil {
+			return err
+		}
+		return sftpUpload(c, r, size, remotePath, mode)
+	case TransferAuto, "":
+		c, err := s.sftpClient()
+		if err != nil {
+			return s.scpUpload(ctx, r, size, remotePath, mode)
+		}
+		return sftpUpload(c, r, size, remotePath, mode)
+	default:
+		return fmt.Errorf("unknown transfer method %q", s.TransferMethod)
+	}
+}
+
+// sftpClient opens the SFTP subsystem once per connection. In auto mode a
+// failure is remembered so later transfers go straight to scp.
+func (s *SSHClient) sftpClient() (*sftp.Client, error) {
+	if s.sftp != nil {
+		return s.sftp, nil
+	}
+	if s.sftpFailed {
+		return nil, fmt.Errorf("SFTP subsystem unavailable")
+	}
+
+	c, err := sftp.NewClient(s.client)
+	if err != nil {
+		s.sftpFailed = true
+		if s.TransferMethod != TransferSFTP {
+			logWarning(fmt.Sprintf("SFTP unavailable (%v), falling back to scp", err))
+		}
+		return nil, fmt.Errorf("failed to start SFTP subsystem: %v", err)
+	}
+	s.sftp = c
+	return c, nil
+}
+
+// sftpUpload writes the file over SFTP and confirms its size afterwards
+func sftpUpload(c *sftp.Client, r io.Reader, size int64, remotePath string, mode os.FileMode) error {
+	if dir := path.Dir(remotePath); dir != "." && dir != "/" {
+		if err := c.MkdirAll(dir); err != nil {
+			return fmt.Errorf("failed to create remote directory %s: %v", dir, err)
+		}
+	}
+
+	f, err := c.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("failed to open remote file: %v", err)
+	}
+
+	// Restrict the mode before any content is written, so secrets are never
+	// readable with the server's default permissions
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to set mode %04o: %v", mode, err)
+	}
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write remote file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close remote file: %v", err)
+	}
+	if n != size {
+		return fmt.Errorf("short write: sent %d of %d bytes", n, size)
+	}
+
+	fi, err := c.Stat(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to confirm upload: %v", err)
+	}
+	if fi.Size() != size {
+		return fmt.Errorf("upload incomplete: remote file has %d of %d bytes", fi.Size(), size)
+	}
+	return nil
+}
+
+// scpUpload sends the file with the scp sink protocol, checking the
+// acknowledgement of every step
+func (s *SSHClient) scpUpload(ctx context.Context, r io.Reader, size int64, remotePath string, mode os.FileMode) error {
+	dir, name := path.Split(remotePath)
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		dir = "."
+	}
+	if dir != "." {
+		if _, err := s.runCommand(ctx, "mkdir -p "+shellQuote(dir)); err != nil {
+			return fmt.Errorf("failed to create remote directory %s: %v", dir, err)
+		}
+	}
+
+	session, err := s.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+	// Closing the session unblocks the copy when ctx is cancelled
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open scp stdin: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open scp stdout: %v", err)
+	}
+	var stderr strings.Builder
+	session.Stderr = &stderr
+
+	scpPath := s.SCPPath
+	if scpPath == "" {
+		scpPath = defaultSCPPath
+	}
+	if err := session.Start(shellQuote(scpPath) + " -t " + shellQuote(dir)); err != nil {
+		return fmt.Errorf("failed to start scp: %v", err)
+	}
+
+	acks := bufio.NewReader(stdout)
+	err = func() error {
+		if err := readSCPAck(acks); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(stdin, "C%04o %d %s\n", mode, size, name); err != nil {
+			return err
+		}
+		if err := readSCPAck(acks); err != nil {
+			return err
+		}
+		n, err := io.Copy(stdin, r)
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return fmt.Errorf("short write: sent %d of %d bytes", n, size)
+		}
+		if _, err := stdin.Write([]byte{0}); err != nil {
+			return err
+		}
+		return readSCPAck(acks)
+	}()
+	stdin.Close()
+
+	waitErr := session.Wait()
+	if err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("scp failed: %v: %s", err, msg)
+		}
+		return fmt.Errorf("scp failed: %v", err)
+	}
+	return nil
+}
+
+// readSCPAck reads a single scp response: 0 for success, 1 (warning) or 2
+// (fatal) followed by an error message line
+func readSCPAck(r *bufio.Reader) error {
+	code, err := r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("scp exited unexpectedly")
+		}
+		return err
+	}
+	if code == 0 {
+		return nil
+	}
+
+	msg, _ := r.ReadString('\n')
+	msg = strings.TrimSpace(msg)
+	if code == 1 || code == 2 {
+		return fmt.Errorf("remote scp: %s", msg)
+	}
+	return fmt.Errorf("unexpected scp response %q", string(code)+msg)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestTransferFileWithRemotePath(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		disableSFTP bool
+	}{
+		{name: "sftp", method: TransferSFTP},
+		{name: "scp", method: TransferSCP},
+		{name: "auto_with_sftp", method: TransferAuto},
+		{name: "auto_falls_back_to_scp", method: TransferAuto, disableSFTP: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestSSHServer(t)
+			server.DisableSFTP = tt.disableSFTP
+
+			client := server.connect(t)
+			client.TransferMethod = tt.method
+
+			localFile := filepath.Join(t.TempDir(), "compose.yml")
+			content := []byte("services:\n  api:\n    image: api\n")
+			if err := os.WriteFile(localFile, content, 0640); err != nil {
+				t.Fatalf("failed to write local file: %v", err)
+			}
+
+			// Nested directories are created and files are replaced
+			for i := 0; i < 2; i++ {
+				if err := client.TransferFileWithRemotePath(context.Background(), localFile, "stacks/app/compose.yml"); err != nil {
+					t.Fatalf("TransferFileWithRemotePath() returned unexpected error: %v", err)
+				}
+			}
+
+			remoteFile := filepath.Join(server.Dir, "stacks", "app", "compose.yml")
+			got, err := os.ReadFile(remoteFile)
+			if err != nil {
+				t.Fatalf("failed to read remote file: %v", err)
+			}
+			if string(got) != string(content) {
+				t.Errorf("remote file = %q, want %q", got, content)
+			}
+
+			fi, err := os.Stat(remoteFile)
+			if err != nil {
+				t.Fatalf("failed to stat remote file: %v", err)
+			}
+			if fi.Mode().Perm() != 0640 {
+				t.Errorf("remote file mode = %04o, want 0640", fi.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestTransferBytes(t *testing.T) {
+	for _, method := range []string{TransferSFTP, TransferSCP} {
+		t.Run(method, func(t *testing.T) {
+			server, client := newTestClient(t)
+			client.TransferMethod = method
+
+			// An existing world-readable file is replaced with the explicit mode
+			remoteFile := filepath.Join(server.Dir, "app", ".env")
+			writeTestFiles(t, server.Dir, map[string]os.FileMode{"app/.env": 0644})
+
+			content := []byte("DB_PASSWORD=secret\n")
+			if err := client.TransferBytes(context.Background(), content, "app/.env", 0600); err != nil {
+				t.Fatalf("TransferBytes() returned unexpected error: %v", err)
+			}
+			if got, _ := os.ReadFile(remoteFile); string(got) != string(content) {
+				t.Errorf("remote file = %q, want %q", got, content)
+			}
+			fi, err := os.Stat(remoteFile)
+			if err != nil {
+				t.Fatalf("failed to stat remote file: %v", err)
+			}
+			if fi.Mode().Perm() != 0600 {
+				t.Errorf("remote file mode = %04o, want 0600", fi.Mode().Perm())
+			}
+
+			// The size must match what the reader delivers
+			if err := client.TransferReader(context.Background(), strings.NewReader("short"), 10, "app/.env", 0600); err == nil {
+				t.Error("TransferReader() should fail when the reader is shorter than size")
+			}
+			assertNoTempFiles(t, server.Dir)
+		})
+	}
+}
+
+func TestTransferErrors(t *testing.T) {
+	server := newTestSSHServer(t)
+	server.DisableSFTP = true
+
+	client := server.connect(t)
+
+	localFile := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(localFile, []byte("DOCKER_TAG=abc1234\n"), 0600); err != nil {
+		t.Fatalf("failed to write local file: %v", err)
+	}
+
+	// Forcing SFTP on a host without the subsystem fails instead of falling back
+	client.TransferMethod = TransferSFTP
+	if err := client.TransferFileWithRemotePath(context.Background(), localFile, ".env"); err == nil {
+		t.Error("expected error when SFTP is unavailable")
+	}
+
+	// A missing scp binary is reported
+	client.TransferMethod = TransferSCP
+	client.SCPPath = "/nonexistent/scp"
+	if err := client.TransferFileWithRemotePath(context.Background(), localFile, ".env"); err == nil {
+		t.Error("expected error for missing scp binary")
+	}
+
+	// Errors from the scp sink are reported, e.g. a directory that can't be created
+	client.SCPPath = ""
+	if err := os.WriteFile(filepath.Join(server.Dir, "file"), nil, 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if err := client.TransferFileWithRemotePath(context.Background(), localFile, "file/.env"); err == nil {
+		t.Error("expected error when the remote directory can't be created")
+	}
+
+	// A directory is never replaced by a file
+	if err := os.Mkdir(filepath.Join(server.Dir, "taken"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	err := client.TransferFileWithRemotePath(context.Background(), localFile, "taken")
+	if err == nil || !strings.Contains(err.Error(), "is a directory") {
+		t.Errorf("expected directory error, got: %v", err)
+	}
+	assertNoTempFiles(t, server.Dir)
+}
+
+// assertNoTempFiles fails if upload temporary files were left behind
+func assertNoTempFiles(t testing.TB, dir string) {
+	t.Helper()
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && strings.Contains(d.Name(), ".tmp-") {
+			t.Errorf("temporary file left behind: %s", p)
+		}
+		return nil
+	})
+}
+
+func TestAtomicReplace(t *testing.T) {
+	for _, method := range []string{TransferSFTP, TransferSCP} {
+		t.Run(method, func(t *testing.T) {
+			server, client := newTestClient(t)
+			client.TransferMethod = method
+
+			remoteFile := filepath.Join(server.Dir, ".env")
+			if err := os.WriteFile(remoteFile, []byte("DOCKER_TAG=old\n"), 0600); err != nil {
+				t.Fatalf("failed to write remote file: %v", err)
+			}
+
+			// A reader failing midway must leave the old version in place
+			err := client.upload(context.Background(), io.MultiReader(strings.NewReader("DOCKER_"), iotest.ErrReader(errors.New("disk error"))), 15, ".env", 0600)
+			if err == nil {
+				t.Fatal("expected error for failing reader")
+			}
+			if got, _ := os.ReadFile(remoteFile); string(got) != "DOCKER_TAG=old\n" {
+				t.Errorf("remote file changed after failed upload: %q", got)
+			}
+
+			// A short upload fails verification and leaves the old version in place
+			if err := client.upload(context.Background(), strings.NewReader("DOCKER_"), 15, ".env", 0600); err == nil {
+				t.Fatal("expected error for short upload")
+			}
+			if got, _ := os.ReadFile(remoteFile); string(got) != "DOCKER_TAG=old\n" {
+				t.Errorf("remote file changed after short upload: %q", got)
+			}
+			assertNoTempFiles(t, server.Dir)
+
+			// A cancelled upload leaves the old version in place
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := client.upload(ctx, strings.NewReader("DOCKER_TAG=new\n"), 15, ".env", 0600); !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected cancellation error, got: %v", err)
+			}
+			if got, _ := os.ReadFile(remoteFile); string(got) != "DOCKER_TAG=old\n" {
+				t.Errorf("remote file changed after cancelled upload: %q", got)
+			}
+			assertNoTempFiles(t, server.Dir)
+
+			// A complete upload replaces the file
+			if err := client.upload(context.Background(), strings.NewReader("DOCKER_TAG=new\n"), 15, ".env", 0600); err != nil {
+				t.Fatalf("upload() returned unexpected error: %v", err)
+			}
+			if got, _ := os.ReadFile(remoteFile); string(got) != "DOCKER_TAG=new\n" {
+				t.Errorf("remote file = %q, want new version", got)
+			}
+			assertNoTempFiles(t, server.Dir)
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"plain":       "'plain'",
+		"with space":  "'with space'",
+		"it's":        `'it'\''s'`,
+		"$(rm -rf /)": "'$(rm -rf /)'",
+		"":            "''",
+	}
+	for in, want := range tests {
+		if got := shellQuote(in); got != want {
+			t.Errorf("shellQuote(%q) = %s, want %s", in, got, want)
+		}
+	}
+}